@@ -1,28 +1,95 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/john-cai/package-indexer/server"
+	"golang.org/x/net/netutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
 	ConnectionLimit        = "PACKAGE_INDEXER_CONNECTION_LIMIT"
 	Port                   = "PACKAGE_INDEXER_PORT"
+	Store                  = "PACKAGE_INDEXER_STORE"
+	MaxPackages            = "PACKAGE_INDEXER_MAX_PACKAGES"
+	MaxDependencies        = "PACKAGE_INDEXER_MAX_DEPENDENCIES"
+	MaxNameLength          = "PACKAGE_INDEXER_MAX_NAME_LENGTH"
+	BackupDir              = "PACKAGE_INDEXER_BACKUP_DIR"
+	ReplicationPort        = "PACKAGE_INDEXER_REPLICATION_PORT"
+	JournalSize            = "PACKAGE_INDEXER_JOURNAL_SIZE"
+	Leader                 = "PACKAGE_INDEXER_LEADER"
+	ClusterID              = "PACKAGE_INDEXER_CLUSTER_ID"
+	ClusterPeers           = "PACKAGE_INDEXER_CLUSTER_PEERS"
+	ClusterDir             = "PACKAGE_INDEXER_CLUSTER_DIR"
+	Upstream               = "PACKAGE_INDEXER_UPSTREAM"
+	UpstreamTLSCA          = "PACKAGE_INDEXER_UPSTREAM_TLS_CA"
+	UpstreamTLSCert        = "PACKAGE_INDEXER_UPSTREAM_TLS_CERT"
+	UpstreamTLSKey         = "PACKAGE_INDEXER_UPSTREAM_TLS_KEY"
+	UpstreamToken          = "PACKAGE_INDEXER_UPSTREAM_TOKEN"
+	ChangesDir             = "PACKAGE_INDEXER_CHANGES_DIR"
+	ChangesFileSize        = "PACKAGE_INDEXER_CHANGES_FILE_SIZE"
+	ChangesFiles           = "PACKAGE_INDEXER_CHANGES_FILES"
+	ChangesWebhook         = "PACKAGE_INDEXER_CHANGES_WEBHOOK"
+	ShutdownTimeout        = "PACKAGE_INDEXER_SHUTDOWN_TIMEOUT"
+	QueueSize              = "PACKAGE_INDEXER_QUEUE_SIZE"
+	QueueTimeout           = "PACKAGE_INDEXER_QUEUE_TIMEOUT"
+	IdleTimeout            = "PACKAGE_INDEXER_IDLE_TIMEOUT"
+	ReadTimeout            = "PACKAGE_INDEXER_READ_TIMEOUT"
+	WriteTimeout           = "PACKAGE_INDEXER_WRITE_TIMEOUT"
+	MaxRequest             = "PACKAGE_INDEXER_MAX_REQUEST_LENGTH"
+	TLSCert                = "PACKAGE_INDEXER_TLS_CERT"
+	TLSKey                 = "PACKAGE_INDEXER_TLS_KEY"
+	TLSClientCA            = "PACKAGE_INDEXER_TLS_CLIENT_CA"
+	Credentials            = "PACKAGE_INDEXER_CREDENTIALS"
+	RequireAuth            = "PACKAGE_INDEXER_REQUIRE_AUTH"
+	ReadRate               = "PACKAGE_INDEXER_READ_RATE"
+	ReadBurst              = "PACKAGE_INDEXER_READ_BURST"
+	WriteRate              = "PACKAGE_INDEXER_WRITE_RATE"
+	WriteBurst             = "PACKAGE_INDEXER_WRITE_BURST"
+	Listen                 = "PACKAGE_INDEXER_LISTEN"
+	SocketMode             = "PACKAGE_INDEXER_SOCKET_MODE"
+	HTTPPort               = "PACKAGE_INDEXER_HTTP_PORT"
+	GRPCPort               = "PACKAGE_INDEXER_GRPC_PORT"
+	RESPPort               = "PACKAGE_INDEXER_RESP_PORT"
+	StatsInterval          = "PACKAGE_INDEXER_STATS_INTERVAL"
 	ConnectionLimitDefault = 100
 	PortDefault            = 8080
+	StoreDefault           = server.StoreMap
+	JournalSizeDefault     = 100000
+	ChangesFileSizeDefault = 64 << 20
+	ShutdownTimeoutDefault = 30
+	QueueSizeDefault       = 100
+	QueueTimeoutDefault    = 5
+	IdleTimeoutDefault     = 300
+	ReadTimeoutDefault     = 10
+	WriteTimeoutDefault    = 10
+	MaxRequestDefault      = 1 << 20
+	StatsIntervalDefault   = 60
 )
 
 func main() {
 	// parse environment variables
 	connectionLimitString := os.Getenv(ConnectionLimit)
 	portString := os.Getenv(Port)
+	storeString := os.Getenv(Store)
 
 	// set default values
 	connectionLimit := ConnectionLimitDefault
 	port := PortDefault
+	storeKind := StoreDefault
 
 	if connectionLimitString != "" {
 		i, err := strconv.Atoi(connectionLimitString)
@@ -41,6 +108,304 @@ func main() {
 		}
 	}
 
-	p := server.NewPackageIndexer(connectionLimit, 1000, server.NewMapStore(), port)
-	p.ListenAndServe()
+	if storeString != "" {
+		storeKind = storeString
+	}
+	store, err := server.NewStore(storeKind)
+	if err != nil {
+		fmt.Printf("%s not a valid value, using default %s", storeString, StoreDefault)
+		store, _ = server.NewStore(StoreDefault)
+	}
+
+	limits := server.Limits{
+		MaxPackages:     intEnv(MaxPackages, 0),
+		MaxDependencies: intEnv(MaxDependencies, 0),
+		MaxNameLength:   intEnv(MaxNameLength, 0),
+	}
+
+	connLimits := server.ConnectionLimits{
+		IdleTimeout:      time.Duration(intEnv(IdleTimeout, IdleTimeoutDefault)) * time.Second,
+		ReadTimeout:      time.Duration(intEnv(ReadTimeout, ReadTimeoutDefault)) * time.Second,
+		WriteTimeout:     time.Duration(intEnv(WriteTimeout, WriteTimeoutDefault)) * time.Second,
+		MaxRequestLength: intEnv(MaxRequest, MaxRequestDefault),
+	}
+	opts := []server.Option{
+		server.WithLimits(limits),
+		server.WithBackupDir(os.Getenv(BackupDir)),
+		server.WithQueueTimeout(time.Duration(intEnv(QueueTimeout, QueueTimeoutDefault)) * time.Second),
+		server.WithConnectionLimits(connLimits),
+	}
+	// with a certificate every connection is served over TLS, and with a client
+	// CA every client has to present a certificate too
+	var tlsConfig *tls.Config
+	if cert := os.Getenv(TLSCert); cert != "" {
+		tlsConfig, err = server.NewTLSConfig(cert, os.Getenv(TLSKey), os.Getenv(TLSClientCA))
+		if err != nil {
+			log.Fatalf("could not load certificate: %s\n", err.Error())
+		}
+		opts = append(opts, server.WithTLS(tlsConfig))
+	}
+
+	// with credentials clients only run what their role allows, and anonymous
+	// clients can only read unless they have to authenticate first
+	if path := os.Getenv(Credentials); path != "" {
+		credentials, err := server.LoadCredentials(path)
+		if err != nil {
+			log.Fatalf("could not load credentials: %s\n", err.Error())
+		}
+		anonymous := server.RoleReader
+		if require, _ := strconv.ParseBool(os.Getenv(RequireAuth)); require {
+			anonymous = server.RoleNone
+		}
+		opts = append(opts, server.WithAuth(credentials, anonymous))
+	}
+
+	// each client gets its own buckets of reads and writes
+	rateLimits := server.RateLimits{
+		Reads:  server.Rate{PerSecond: floatEnv(ReadRate, 0), Burst: intEnv(ReadBurst, 0)},
+		Writes: server.Rate{PerSecond: floatEnv(WriteRate, 0), Burst: intEnv(WriteBurst, 0)},
+	}
+	if rateLimits.Reads.PerSecond > 0 || rateLimits.Writes.PerSecond > 0 {
+		opts = append(opts, server.WithRateLimits(rateLimits))
+	}
+
+	// listen on every address given instead of the port on every interface
+	if listen := os.Getenv(Listen); listen != "" {
+		opts = append(opts, server.WithListenAddrs(strings.Split(listen, ",")...))
+	}
+	if modeString := os.Getenv(SocketMode); modeString != "" {
+		mode, err := strconv.ParseUint(modeString, 8, 32)
+		if err != nil {
+			log.Fatalf("invalid %s: %s\n", SocketMode, err.Error())
+		}
+		opts = append(opts, server.WithSocketMode(os.FileMode(mode)))
+	}
+
+	// run in order once the server has shut down
+	var cleanups []func()
+
+	// the journal records every mutation, for followers and for the change feeds
+	var sinks []server.Sink
+	if dir := os.Getenv(ChangesDir); dir != "" {
+		sink, err := server.NewFileSink(dir, int64(intEnv(ChangesFileSize, ChangesFileSizeDefault)), intEnv(ChangesFiles, 0))
+		if err != nil {
+			log.Fatalf("could not open change files: %s\n", err.Error())
+		}
+		sinks = append(sinks, sink)
+		cleanups = append(cleanups, func() { sink.Close() })
+	}
+	if url := os.Getenv(ChangesWebhook); url != "" {
+		sinks = append(sinks, server.NewWebhookSink(url))
+	}
+	replicationPort := intEnv(ReplicationPort, 0)
+	// Watch calls of the gRPC API are served from the journal too
+	grpcPort := intEnv(GRPCPort, 0)
+	var journal *server.Journal
+	if replicationPort != 0 || len(sinks) > 0 || grpcPort != 0 {
+		journal = server.NewJournal(intEnv(JournalSize, JournalSizeDefault))
+		opts = append(opts, server.WithJournal(journal))
+	}
+	feeds, stopFeeds := context.WithCancel(context.Background())
+	cleanups = append([]func(){stopFeeds}, cleanups...)
+	for _, sink := range sinks {
+		go server.NewFeed(journal, sink).Run(feeds)
+	}
+
+	// a cluster node agrees with its peers on every mutation through raft
+	if id := os.Getenv(ClusterID); id != "" {
+		peers, err := parsePeers(os.Getenv(ClusterPeers))
+		if err != nil {
+			log.Fatalf("invalid %s: %s\n", ClusterPeers, err.Error())
+		}
+		if peers[id] == "" {
+			log.Fatalf("%s must include this node, %s\n", ClusterPeers, id)
+		}
+		node, err := server.OpenClusterNode(id, peers[id], os.Getenv(ClusterDir), store, limits, journal)
+		if err != nil {
+			log.Fatalf("could not start cluster node: %s\n", err.Error())
+		}
+		if err := node.Bootstrap(peers); err != nil {
+			log.Fatalf("could not bootstrap cluster: %s\n", err.Error())
+		}
+		opts = append(opts, server.WithCluster(node))
+		cleanups = append(cleanups, func() { node.Shutdown() })
+	}
+
+	// a mirror answers from its own store and reads through to its upstream,
+	// connecting to it like any other client
+	if upstream := os.Getenv(Upstream); upstream != "" {
+		config := server.ClientConfig{Token: os.Getenv(UpstreamToken)}
+		if ca := os.Getenv(UpstreamTLSCA); ca != "" {
+			config.TLS, err = server.NewClientTLSConfig(ca, os.Getenv(UpstreamTLSCert), os.Getenv(UpstreamTLSKey))
+			if err != nil {
+				log.Fatalf("could not load upstream certificates: %s\n", err.Error())
+			}
+		}
+		opts = append(opts, server.WithMirror(server.NewMirror(upstream, store, config)))
+	}
+
+	// a follower replicates everything from its leader and only serves reads,
+	// a leader journals its mutations for its followers
+	if leader := os.Getenv(Leader); leader != "" {
+		opts = append(opts, server.WithReadOnly())
+		go server.NewFollower(leader, store).Run(context.Background())
+	} else if replicationPort != 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", replicationPort))
+		if err != nil {
+			log.Fatalf("could not start replication server: %s\n", err.Error())
+		}
+		go func() {
+			log.Fatalf("replication server stopped: %s", server.NewReplicationServer(journal, store).Serve(ln))
+		}()
+	}
+
+	p := server.NewPackageIndexer(intEnv(QueueSize, QueueSizeDefault), connectionLimit, store, port, opts...)
+
+	// front ends other than the line protocol, stopped before the indexer so
+	// that their requests are done by the time the cleanups run
+	var frontends []func(ctx context.Context) error
+
+	// HTTP clients get the same timeouts as the line protocol, and as many
+	// connections at once as it has workers
+	if httpPort := intEnv(HTTPPort, 0); httpPort != 0 {
+		httpServer := &http.Server{
+			Handler:           p.HTTPHandler(),
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: connLimits.ReadTimeout,
+			ReadTimeout:       connLimits.ReadTimeout,
+			WriteTimeout:      connLimits.WriteTimeout,
+			IdleTimeout:       connLimits.IdleTimeout,
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", httpPort))
+		if err != nil {
+			log.Fatalf("could not start http server: %s\n", err.Error())
+		}
+		ln = netutil.LimitListener(ln, connectionLimit)
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = httpServer.ServeTLS(ln, "", "")
+			} else {
+				err = httpServer.Serve(ln)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatalf("could not start http server: %s\n", err.Error())
+			}
+		}()
+		frontends = append(frontends, httpServer.Shutdown)
+	}
+
+	if grpcPort != 0 {
+		var grpcOpts []grpc.ServerOption
+		if tlsConfig != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer := p.GRPCServer(grpcOpts...)
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+		if err != nil {
+			log.Fatalf("could not start grpc server: %s\n", err.Error())
+		}
+		go func() {
+			if err := grpcServer.Serve(ln); err != nil {
+				log.Fatalf("grpc server stopped: %s\n", err.Error())
+			}
+		}()
+		frontends = append(frontends, grpcServer.Shutdown)
+	}
+
+	// RESP clients are served by the indexer's workers, Shutdown stops them too
+	if respPort := intEnv(RESPPort, 0); respPort != 0 {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", respPort))
+		if err != nil {
+			log.Fatalf("could not start resp server: %s\n", err.Error())
+		}
+		go func() {
+			if err := p.ServeRESP(context.Background(), ln); err != server.ErrServerClosed {
+				log.Fatalf("resp server stopped: %s\n", err.Error())
+			}
+		}()
+	}
+
+	// every so often, log what became of the connections and requests
+	if interval := intEnv(StatsInterval, StatsIntervalDefault); interval > 0 {
+		go logStats(p, time.Duration(interval)*time.Second)
+	}
+
+	// on SIGINT or SIGTERM, give the requests in progress a while to finish
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("received %s, shutting down", <-signals)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(intEnv(ShutdownTimeout, ShutdownTimeoutDefault))*time.Second)
+		defer cancel()
+		for _, stop := range frontends {
+			if err := stop(ctx); err != nil {
+				log.Printf("could not stop front end gracefully: %s", err.Error())
+			}
+		}
+		if err := p.Shutdown(ctx); err != nil {
+			log.Printf("could not shut down gracefully: %s", err.Error())
+		}
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+		close(stopped)
+	}()
+
+	if err := p.ListenAndServe(); err != server.ErrServerClosed {
+		log.Fatalf("could not start tcp server: %s\n", err.Error())
+	}
+	<-stopped
+}
+
+// parsePeers parses a comma separated list of id=address cluster members
+func parsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	for _, peer := range strings.Split(s, ",") {
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not id=address", peer)
+		}
+		peers[parts[0]] = parts[1]
+	}
+	return peers, nil
+}
+
+// intEnv returns the value of the environment variable name as an int, or def
+// if it isn't set or isn't a valid value
+func intEnv(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		fmt.Printf("%s not a valid value, using default %d", s, def)
+		return def
+	}
+	return i
+}
+
+func floatEnv(name string, def float64) float64 {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		fmt.Printf("%s not a valid value, using default %g", s, def)
+		return def
+	}
+	return f
+}
+
+// logStats logs the admission and rate limit counters of p every interval
+func logStats(p *server.PackageIndexer, interval time.Duration) {
+	for range time.Tick(interval) {
+		a, r := p.AdmissionStats(), p.RateLimitStats()
+		log.Printf("connections: %d admitted, %d rejected, %d timed out, %d queued; reads: %d allowed, %d throttled; writes: %d allowed, %d throttled; %d clients rate limited",
+			a.Admitted, a.Rejected, a.TimedOut, a.Queued, r.ReadsAllowed, r.ReadsThrottled, r.WritesAllowed, r.WritesThrottled, r.Buckets)
+	}
 }
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// how long a connection turned away gets to take its BUSY answer
+const busyTimeout = time.Second
+
+// AdmissionStats counts what became of the connections accepted so far
+type AdmissionStats struct {
+	// connections handed to a worker
+	Admitted uint64
+	// connections answered with BUSY because the queue was full
+	Rejected uint64
+	// connections answered with BUSY after waiting in the queue for too long
+	TimedOut uint64
+	// connections waiting for a worker right now
+	Queued int
+}
+
+type admissionStats struct {
+	admitted uint64
+	rejected uint64
+	timedOut uint64
+}
+
+// AdmissionStats returns how many connections were admitted and turned away
+func (p *PackageIndexer) AdmissionStats() AdmissionStats {
+	return AdmissionStats{
+		Admitted: atomic.LoadUint64(&p.admission.admitted),
+		Rejected: atomic.LoadUint64(&p.admission.rejected),
+		TimedOut: atomic.LoadUint64(&p.admission.timedOut),
+		Queued:   len(p.queue),
+	}
+}
+
+// admit hands conn to a free worker. If there is none, conn waits in the queue
+// for one, unless the queue is full or it waits longer than the queue timeout,
+// in which case it's answered with BUSY and closed. admit never blocks, so
+// that the accept loop can keep turning connections away.
+func (p *PackageIndexer) admit(conn net.Conn, proto protocol) {
+	select {
+	case worker := <-p.workerChan:
+		go p.serveConn(worker, conn, proto)
+		return
+	default:
+	}
+
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		atomic.AddUint64(&p.admission.rejected, 1)
+		go p.busy(conn, proto, "the queue is full")
+		return
+	}
+
+	go func() {
+		var timeout <-chan time.Time
+		if p.queueTimeout > 0 {
+			timer := time.NewTimer(p.queueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case worker := <-p.workerChan:
+			<-p.queue
+			p.serveConn(worker, conn, proto)
+		case <-timeout:
+			<-p.queue
+			atomic.AddUint64(&p.admission.timedOut, 1)
+			p.busy(conn, proto, "no worker was free in time")
+		}
+	}()
+}
+
+// serveConn has worker handle every request on conn, and frees the worker
+// once conn is closed
+func (p *PackageIndexer) serveConn(worker *Worker, conn net.Conn, proto protocol) {
+	atomic.AddUint64(&p.admission.admitted, 1)
+	proto.serve(worker, conn)
+	p.workerChan <- worker
+}
+
+// busy answers conn with BUSY and closes it
+func (p *PackageIndexer) busy(conn net.Conn, proto protocol, reason string) {
+	log.Printf("turned away %s: %s", conn.RemoteAddr(), reason)
+	//METRICS: increment rejected connections count
+	conn.SetWriteDeadline(time.Now().Add(busyTimeout))
+	if _, err := conn.Write([]byte(proto.busy)); err != nil {
+		log.Printf("error writing to connection %s", err.Error())
+	}
+	conn.Close()
+	p.conns.remove(conn)
+}
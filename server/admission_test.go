@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// waitForAdmission waits for the indexer's counters to reach expected
+func waitForAdmission(t *testing.T, p *PackageIndexer, expected AdmissionStats) {
+	deadline := time.Now().Add(10 * time.Second)
+	for p.AdmissionStats() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %+v, got %+v", expected, p.AdmissionStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Testing that connections over the limit wait in the queue, and are turned
+// away with BUSY once it's full or they waited too long
+func TestAdmission(t *testing.T) {
+	p := NewPackageIndexer(1, 1, NewMapStore(), 0, WithQueueTimeout(200*time.Millisecond))
+	addr, _ := startIndexer(t, p)
+
+	active := dialIndexer(t, addr)
+	active.send(t, "INDEX|a|")
+	if response, _ := active.receive(); response != ResponseOK {
+		t.Fatalf("expected %s, got %s", ResponseOK, response)
+	}
+
+	queued := dialIndexer(t, addr)
+	waitForAdmission(t, p, AdmissionStats{Admitted: 1, Queued: 1})
+	rejected := dialIndexer(t, addr)
+	if response, _ := rejected.receive(); response != ResponseBusy {
+		t.Errorf("expected %s with the queue full, got %s", ResponseBusy, response)
+	}
+	if _, err := rejected.receive(); err == nil {
+		t.Error("expected the rejected connection to be closed")
+	}
+	if response, _ := queued.receive(); response != ResponseBusy {
+		t.Errorf("expected %s after the queue timeout, got %s", ResponseBusy, response)
+	}
+	waitForAdmission(t, p, AdmissionStats{Admitted: 1, Rejected: 1, TimedOut: 1})
+
+	// a connection waiting when the worker frees up gets it
+	queued = dialIndexer(t, addr)
+	waitForAdmission(t, p, AdmissionStats{Admitted: 1, Rejected: 1, TimedOut: 1, Queued: 1})
+	active.Close()
+	queued.send(t, "QUERY|a|")
+	if response, _ := queued.receive(); response != ResponseOK {
+		t.Errorf("expected the queued connection to be served, got %s", response)
+	}
+	waitForAdmission(t, p, AdmissionStats{Admitted: 2, Rejected: 1, TimedOut: 1})
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Role is what a client is allowed to do, each role can do everything the ones
+// before it can
+type Role int
+
+const (
+	// nothing but AUTH
+	RoleNone Role = iota
+	// QUERY, DIGEST and FETCH
+	RoleReader
+	// INDEX and REMOVE as well
+	RoleWriter
+	// FSCK, BACKUP and RESTORE as well
+	RoleAdmin
+)
+
+var roleNames = []string{"none", "reader", "writer", "admin"}
+
+func (r Role) String() string {
+	if r < RoleNone || r > RoleAdmin {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+// ParseRole returns the role called name
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if n == name {
+			return Role(i), nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q", name)
+}
+
+// Identity is who a client authenticated as
+type Identity struct {
+	Name string
+	Role Role
+}
+
+// Credentials maps tokens to the identities they authenticate as. Only hashes
+// of the tokens are kept, so that looking one up doesn't take more or less
+// time depending on how much of it is right.
+type Credentials struct {
+	identities map[[sha256.Size]byte]Identity
+}
+
+// LoadCredentials reads a credentials file, with one identity per line made of
+// its name, its role and its token, separated by spaces, e.g.
+//
+//	ci writer 8c6f0a1e9b7d4c3f
+//
+// Empty lines and lines starting with # are skipped.
+func LoadCredentials(path string) (*Credentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Credentials{identities: make(map[[sha256.Size]byte]Identity)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, role and token", path, line)
+		}
+		role, err := ParseRole(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+		hash := sha256.Sum256([]byte(fields[2]))
+		if _, ok := c.identities[hash]; ok {
+			return nil, fmt.Errorf("%s:%d: token of %s is already used", path, line, fields[0])
+		}
+		c.identities[hash] = Identity{Name: fields[0], Role: role}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Authenticate returns the identity token authenticates as, and false if it
+// doesn't authenticate as anyone
+func (c *Credentials) Authenticate(token string) (Identity, bool) {
+	identity, ok := c.identities[sha256.Sum256([]byte(token))]
+	return identity, ok
+}
+
+// requiredRole returns the role needed to run the request
+func requiredRole(r *Request) Role {
+	switch r.command {
+	case CmdQuery, CmdDigest, CmdFetch:
+		return RoleReader
+	case CmdIndex, CmdRemove:
+		return RoleWriter
+	}
+	return RoleAdmin
+}
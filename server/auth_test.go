@@ -0,0 +1,104 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCredentials writes a credentials file made of lines and loads it
+func writeCredentials(t *testing.T, lines ...string) (*Credentials, error) {
+	path := filepath.Join(tempDir(t), "credentials")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadCredentials(path)
+}
+
+// Testing that clients can only run what their role allows
+func TestAuth(t *testing.T) {
+	credentials, err := writeCredentials(t,
+		"# name role token",
+		"ci writer writer-token",
+		"",
+		"ops admin admin-token",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := serveWorker(t, &Worker{store: NewMapStore(), credentials: credentials, anonymous: RoleReader})
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"QUERY|a|", ResponseFail},
+		{"INDEX|a|", ResponseDenied},
+		{"AUTH|wrong-token|", ResponseDenied},
+		{"INDEX|a|", ResponseDenied},
+		{"AUTH|writer-token|", ResponseOK},
+		{"INDEX|a|", ResponseOK},
+		{"QUERY|a|", ResponseOK},
+		{"FSCK|check|", ResponseDenied},
+		{"AUTH|admin-token|", ResponseOK},
+		{"FSCK|check|", ResponseOK},
+		{"REMOVE|a|", ResponseOK},
+	}
+	for _, test := range tests {
+		if actual := send(test.request); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, actual)
+		}
+	}
+}
+
+// Testing that clients can't do anything before AUTH when it's required, and
+// that AUTH is an error without credentials
+func TestRequireAuth(t *testing.T) {
+	credentials, err := writeCredentials(t, "reporting reader reader-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := serveWorker(t, &Worker{store: NewMapStore(), credentials: credentials, anonymous: RoleNone})
+	for _, test := range []struct {
+		request  string
+		expected string
+	}{
+		{"QUERY|a|", ResponseDenied},
+		{"AUTH|reader-token|", ResponseOK},
+		{"QUERY|a|", ResponseFail},
+		{"INDEX|a|", ResponseDenied},
+	} {
+		if actual := send(test.request); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, actual)
+		}
+	}
+
+	send = serveWorker(t, &Worker{store: NewMapStore()})
+	if actual := send("AUTH|reader-token|"); actual != ResponseError {
+		t.Errorf("expected %s without credentials, got %s", ResponseError, actual)
+	}
+	if actual := send("INDEX|a|"); actual != ResponseOK {
+		t.Errorf("expected every command to be allowed without credentials, got %s", actual)
+	}
+}
+
+// Testing that invalid credentials files are refused
+func TestLoadCredentials(t *testing.T) {
+	for _, lines := range [][]string{
+		{"ci writer"},
+		{"ci superuser token"},
+		{"ci writer token", "ops admin token"},
+	} {
+		if _, err := writeCredentials(t, lines...); err == nil {
+			t.Errorf("expected %q to be refused", lines)
+		}
+	}
+	credentials, err := writeCredentials(t, "ci writer token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity, ok := credentials.Authenticate("token"); !ok || identity != (Identity{Name: "ci", Role: RoleWriter}) {
+		t.Errorf("expected ci, a writer, got %+v %t", identity, ok)
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// the most events handed to a sink at once
+	feedBatch = 1000
+	// how long to wait before retrying a sink, doubled on every failure
+	feedRetryMin = 100 * time.Millisecond
+	feedRetryMax = 30 * time.Second
+
+	webhookTimeout = 10 * time.Second
+)
+
+// Sink receives the changes to the store, as events in the format of Mutation.
+// Deliver must only return nil once the events are safely stored, or it gets
+// them again.
+//
+// An event with command RESET means the store was replaced or repaired, and
+// whoever consumes the events has to start over from a snapshot of the store.
+type Sink interface {
+	Deliver(events []Mutation) error
+}
+
+// Feed delivers every mutation recorded in a journal to a sink, in order and
+// at least once for as long as the process runs. A batch the sink fails to
+// take is retried, with increasing delays, until it succeeds, so the sink may
+// see an event again after a failure and should use its journal and sequence
+// number to tell. The journal keeps every event the feed hasn't delivered, so
+// a sink that is down keeps them in memory, however many there are. Events
+// still in the journal when the process stops are lost, and a new journal
+// starts over at sequence number 1.
+type Feed struct {
+	journal *Journal
+	sink    Sink
+	// sequence number of the last event delivered
+	delivered uint64
+}
+
+// NewFeed returns a feed of the mutations recorded in journal from now on
+func NewFeed(journal *Journal, sink Sink) *Feed {
+	f := &Feed{journal: journal, sink: sink}
+	f.delivered = journal.hold(f)
+	return f
+}
+
+// Delivered returns the sequence number of the last event delivered
+func (f *Feed) Delivered() uint64 {
+	return atomic.LoadUint64(&f.delivered)
+}
+
+// Run delivers events until ctx is cancelled
+func (f *Feed) Run(ctx context.Context) error {
+	retry := feedRetryMin
+	for {
+		// get the wait channel before reading, so nothing appended in between is missed
+		changed := f.journal.wait()
+		// the journal holds on to every event the feed hasn't delivered
+		events, _ := f.journal.since(f.Delivered()+1, feedBatch)
+		for i := range events {
+			events[i].Journal = f.journal.ID()
+		}
+
+		if len(events) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-changed:
+			}
+			continue
+		}
+
+		if err := f.sink.Deliver(events); err != nil {
+			log.Printf("could not deliver events %d to %d, retrying in %s: %s", events[0].Seq, events[len(events)-1].Seq, retry, err.Error())
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(retry):
+			}
+			if retry < feedRetryMax {
+				retry *= 2
+			}
+			continue
+		}
+		retry = feedRetryMin
+		atomic.StoreUint64(&f.delivered, events[len(events)-1].Seq)
+		f.journal.delivered(f, events[len(events)-1].Seq)
+	}
+}
+
+// FileSink writes events to JSON lines files in a directory, one event per
+// line. Each file is named after the epoch of the sink and the sequence number
+// of its first event, and a new one is started for the next delivery once the
+// current one reaches its size limit. The epoch goes up by one every time a
+// sink is opened on the directory, so files sort by (epoch, seq) in the order
+// they were written even though sequence numbers start over with the journal.
+type FileSink struct {
+	dir      string
+	maxBytes int64
+	// files kept, the oldest ones are deleted, 0 keeps them all
+	keep  int
+	epoch uint64
+
+	l    sync.Mutex
+	f    *os.File
+	size int64
+}
+
+const (
+	changeFilePrefix = "changes-"
+	changeFileSuffix = ".jsonl"
+)
+
+// NewFileSink returns a sink writing to dir. It starts a new epoch, so the
+// first delivery starts a new file after the ones already there.
+func NewFileSink(dir string, maxBytes int64, keep int) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileSink{dir: dir, maxBytes: maxBytes, keep: keep}
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		s.epoch = files[len(files)-1].epoch
+	}
+	s.epoch++
+	return s, nil
+}
+
+// Deliver appends events to the current file, starting a new one first if it
+// is full, and syncs it
+func (s *FileSink) Deliver(events []Mutation) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.f == nil || s.size >= s.maxBytes {
+		if err := s.rotate(events[0].Seq); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	size := int64(w.Buffered())
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.size += size
+	return s.f.Sync()
+}
+
+// Close closes the current file
+func (s *FileSink) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// rotate starts a new file for events from seq on, and deletes the oldest
+// files over the limit
+func (s *FileSink) rotate(seq uint64) error {
+	if s.f != nil {
+		if err := s.f.Close(); err != nil {
+			return err
+		}
+		s.f = nil
+	}
+	if err := s.open(fmt.Sprintf("%s%010d-%020d%s", changeFilePrefix, s.epoch, seq, changeFileSuffix)); err != nil {
+		return err
+	}
+
+	if s.keep <= 0 {
+		return nil
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for len(files) > s.keep {
+		if err := os.Remove(filepath.Join(s.dir, files[0].name)); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (s *FileSink) open(name string) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+// changeFile is a file written by a FileSink
+type changeFile struct {
+	name       string
+	epoch, seq uint64
+}
+
+// parseChangeFile parses the epoch and sequence number out of a change file
+// name
+func parseChangeFile(name string) (changeFile, bool) {
+	if !strings.HasPrefix(name, changeFilePrefix) || !strings.HasSuffix(name, changeFileSuffix) {
+		return changeFile{}, false
+	}
+	fields := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, changeFilePrefix), changeFileSuffix), "-")
+	if len(fields) != 2 {
+		return changeFile{}, false
+	}
+	f := changeFile{name: name}
+	var err error
+	if f.epoch, err = strconv.ParseUint(fields[0], 10, 64); err == nil {
+		f.seq, err = strconv.ParseUint(fields[1], 10, 64)
+	}
+	return f, err == nil
+}
+
+// files returns the change files in the directory, oldest first
+func (s *FileSink) files() ([]changeFile, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []changeFile
+	for _, info := range infos {
+		if f, ok := parseChangeFile(info.Name()); ok {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].epoch != files[j].epoch {
+			return files[i].epoch < files[j].epoch
+		}
+		return files[i].seq < files[j].seq
+	})
+	return files, nil
+}
+
+// WebhookSink posts events to a URL as a JSON array. Anything but a 2xx
+// response is a failure, and the feed posts the same events again.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink posting to url
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (s *WebhookSink) Deliver(events []Mutation) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", s.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runFeed runs f until the test ends
+func runFeed(t *testing.T, f *Feed) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForFeed waits for f to deliver everything up to seq
+func waitForFeed(t *testing.T, f *Feed, seq uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for f.Delivered() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected events up to %d to be delivered, got %d", seq, f.Delivered())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Testing that events are written to rotating files, in order
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal := NewJournal(100)
+	w := &Worker{store: NewMapStore(), journal: journal}
+	sink, err := NewFileSink(dir, 300, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	f := NewFeed(journal, sink)
+	runFeed(t, f)
+
+	// a file is only started between deliveries, so deliver a few at a time
+	w.Index(NewPackage("a", nil))
+	waitForFeed(t, f, 1)
+	for i := 0; i < 20; i++ {
+		w.Index(NewPackage(fmt.Sprintf("pkg-%d", i), []string{"a"}))
+		waitForFeed(t, f, journal.Last())
+	}
+	w.Remove("pkg-0")
+	waitForFeed(t, f, journal.Last())
+
+	files, err := filepath.Glob(filepath.Join(dir, changeFilePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("expected the 3 newest files to be kept, got %v", files)
+	}
+
+	var events []Mutation
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var e Mutation
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Fatalf("invalid event %s: %s", scanner.Text(), err.Error())
+			}
+			events = append(events, e)
+		}
+		file.Close()
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Seq != events[i-1].Seq+1 {
+			t.Fatalf("expected events in order, got %d after %d", events[i].Seq, events[i-1].Seq)
+		}
+	}
+	last := events[len(events)-1]
+	if last.Seq != journal.Last() || last.Command != CmdRemove || last.Package != "pkg-0" || last.Time.IsZero() || last.Journal != journal.ID() {
+		t.Errorf("expected the removal of pkg-0 in journal %s last, got %+v", journal.ID(), last)
+	}
+
+	// a new sink starts a new epoch, whose files are kept over the older ones
+	// although sequence numbers start over
+	sink.Close()
+	sink, err = NewFileSink(dir, 1<<20, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Deliver([]Mutation{{Seq: 1, Command: CmdIndex, Package: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := filepath.Glob(filepath.Join(dir, changeFilePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newest := filepath.Join(dir, fmt.Sprintf("%s%010d-%020d%s", changeFilePrefix, 2, 1, changeFileSuffix))
+	if len(after) != 3 || after[2] != newest || after[0] != files[1] {
+		t.Errorf("expected %s to be kept with the 2 newest files of the first epoch, got %v", newest, after)
+	}
+}
+
+// Testing that change files sort by epoch then sequence number
+func TestParseChangeFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		ok         bool
+		epoch, seq uint64
+	}{
+		{"changes-0000000003-00000000000000000007.jsonl", true, 3, 7},
+		{"changes-x.jsonl", false, 0, 0},
+		{"changes-1-2-3.jsonl", false, 0, 0},
+		{"other-1.jsonl", false, 0, 0},
+	}
+	for _, test := range tests {
+		f, ok := parseChangeFile(test.name)
+		if ok != test.ok || f.epoch != test.epoch || f.seq != test.seq {
+			t.Errorf("%s: expected %v epoch %d seq %d, got %v epoch %d seq %d", test.name, test.ok, test.epoch, test.seq, ok, f.epoch, f.seq)
+		}
+	}
+}
+
+// webhookStandIn accepts events, failing the first requests
+type webhookStandIn struct {
+	l        sync.Mutex
+	failures int
+	events   []Mutation
+}
+
+func (s *webhookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var events []Mutation
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.events = append(s.events, events...)
+}
+
+// Testing that a webhook gets every event, even when it fails at first
+func TestWebhookSink(t *testing.T) {
+	standIn := &webhookStandIn{failures: 2}
+	ts := httptest.NewServer(standIn)
+	defer ts.Close()
+
+	journal := NewJournal(100)
+	w := &Worker{store: NewMapStore(), journal: journal}
+	f := NewFeed(journal, NewWebhookSink(ts.URL))
+	w.Index(NewPackage("a", nil))
+	w.Index(NewPackage("b", []string{"a"}))
+	w.Remove("b")
+	runFeed(t, f)
+	waitForFeed(t, f, 3)
+
+	standIn.l.Lock()
+	defer standIn.l.Unlock()
+	if standIn.failures != 0 {
+		t.Errorf("expected the failed requests to be retried")
+	}
+	expected := []string{"INDEX a", "INDEX b", "REMOVE b"}
+	seen := make(map[uint64]bool)
+	var got []string
+	for _, e := range standIn.events {
+		if seen[e.Seq] {
+			continue
+		}
+		seen[e.Seq] = true
+		got = append(got, e.Command+" "+e.Package)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// Testing that a webhook failing for longer than the journal goes still gets
+// every event, and that the journal lets go of them once delivered
+func TestFeedBehindJournal(t *testing.T) {
+	standIn := &webhookStandIn{failures: 3}
+	ts := httptest.NewServer(standIn)
+	defer ts.Close()
+
+	journal := NewJournal(2)
+	w := &Worker{store: NewMapStore(), journal: journal}
+	f := NewFeed(journal, NewWebhookSink(ts.URL))
+	runFeed(t, f)
+	for i := 0; i < 5; i++ {
+		w.Index(NewPackage(fmt.Sprintf("pkg-%d", i), nil))
+	}
+	waitForFeed(t, f, 5)
+
+	standIn.l.Lock()
+	defer standIn.l.Unlock()
+	if standIn.failures != 0 {
+		t.Errorf("expected the failed requests to be retried")
+	}
+	var seqs []uint64
+	for _, e := range standIn.events {
+		if e.Command != CmdIndex {
+			t.Errorf("expected nothing but INDEX, got %+v", e)
+		}
+		if len(seqs) == 0 || e.Seq > seqs[len(seqs)-1] {
+			seqs = append(seqs, e.Seq)
+		}
+	}
+	if fmt.Sprint(seqs) != "[1 2 3 4 5]" {
+		t.Errorf("expected events 1 to 5, got %v", seqs)
+	}
+	if first := journal.First(); first != 4 {
+		t.Errorf("expected the journal to keep the last 2 events, got %d onwards", first)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// how long a client waits for the indexer to connect or answer
+const clientTimeout = 10 * time.Second
+
+// Client talks to an indexer over its line protocol, like the test-suite's
+// client but handing back whole responses. It isn't safe for concurrent use.
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// ClientConfig is how a Client connects to an indexer
+type ClientConfig struct {
+	// connects over TLS if set, see NewClientTLSConfig
+	TLS *tls.Config
+	// sent with AUTH once connected, if set
+	Token string
+}
+
+// Dial connects to the indexer listening at addr over plain TCP
+func Dial(addr string) (*Client, error) {
+	return ClientConfig{}.Dial(addr)
+}
+
+// Dial connects to the indexer listening at addr, and authenticates if the
+// config has a token
+func (c ClientConfig) Dial(addr string) (*Client, error) {
+	dialer := &net.Dialer{Timeout: clientTimeout}
+	var conn net.Conn
+	var err error
+	if c.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, c.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{conn: conn, reader: bufio.NewReader(conn)}
+	if c.Token == "" {
+		return client, nil
+	}
+	response, err := client.Send(fmt.Sprintf("%s|%s|", CmdAuth, c.Token))
+	if err == nil && response != ResponseOK {
+		err = fmt.Errorf("AUTH answered %s", response)
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Send sends a single request and returns the response, without the newline
+func (c *Client) Send(request string) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(clientTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s\n", request); err != nil {
+		return "", err
+	}
+	response, err := c.reader.ReadString('\n')
+	return strings.TrimSuffix(response, "\n"), err
+}
+
+// Digest asks the indexer for the node at path of its digest
+func (c *Client) Digest(path string) (*DigestNode, error) {
+	response, err := c.Send(digestRequest(path))
+	if err != nil {
+		return nil, err
+	}
+	return parseDigest(path, response)
+}
+
+// Fetch asks the indexer for the package called name and every package it
+// depends on, directly or not. It returns false if there's no such package.
+func (c *Client) Fetch(name string) ([]*Package, bool, error) {
+	response, err := c.Send(fetchRequest(name))
+	if err != nil {
+		return nil, false, err
+	}
+	return parseFetch(name, response)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// ErrNotLeader is returned by a cluster node asked to do something only the
+// leader can do
+var ErrNotLeader = errors.New("not the cluster leader")
+
+const (
+	// how long a mutation may take to be committed before giving up
+	clusterApplyTimeout = 5 * time.Second
+	// raft snapshots kept on disk
+	clusterSnapshotsRetained = 2
+	clusterMaxPool           = 3
+)
+
+// ClusterConfig describes a node of a replicated cluster. Transport connects
+// it to the other nodes, and Logs, Stable and Snapshots keep its raft state.
+type ClusterConfig struct {
+	ID        string
+	Transport raft.Transport
+	Logs      raft.LogStore
+	Stable    raft.StableStore
+	Snapshots raft.SnapshotStore
+	// applied to every mutation, so they should be the same on every node
+	Limits Limits
+	// records every mutation the node applies, if set
+	Journal *Journal
+	// raft settings, raft.DefaultConfig if nil. LocalID is always set to ID.
+	Raft *raft.Config
+}
+
+// ClusterNode is a member of a cluster of indexers agreeing on their packages
+// through raft. INDEX and REMOVE are committed to the raft log by the leader
+// and applied to the store of every node in the same order. QUERY is answered
+// by the leader only, once it has confirmed that it still is the leader, so a
+// query sees every mutation acknowledged before it.
+type ClusterNode struct {
+	raft   *raft.Raft
+	store  PackageStore
+	worker *Worker
+	// the raft log opened by OpenClusterNode, closed on shutdown
+	logs io.Closer
+
+	// the term in which the node, as leader, has applied every entry committed
+	// by previous leaders
+	readyTerm uint64
+}
+
+// NewClusterNode starts a node applying the raft log to store. Nothing else
+// should write to store. A new cluster must be bootstrapped once, see
+// Bootstrap.
+func NewClusterNode(config ClusterConfig, store PackageStore) (*ClusterNode, error) {
+	conf := raft.DefaultConfig()
+	if config.Raft != nil {
+		c := *config.Raft
+		conf = &c
+	}
+	conf.LocalID = raft.ServerID(config.ID)
+
+	worker := NewWorker(store)
+	worker.limits = config.Limits
+	worker.journal = config.Journal
+	fsm := &clusterFSM{store: store, worker: worker}
+	r, err := raft.NewRaft(conf, fsm, config.Logs, config.Stable, config.Snapshots, config.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return &ClusterNode{raft: r, store: store, worker: worker}, nil
+}
+
+// OpenClusterNode starts a node talking to the other nodes over TCP on addr,
+// and keeping its raft log and snapshots in dir so that it can be restarted
+func OpenClusterNode(id, addr, dir string, store PackageStore, limits Limits, journal *Journal) (*ClusterNode, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	logs, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(dir, "raft.db")})
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, clusterSnapshotsRetained, os.Stderr)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(addr, nil, clusterMaxPool, clusterApplyTimeout, os.Stderr)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+	node, err := NewClusterNode(ClusterConfig{
+		ID:        id,
+		Transport: transport,
+		Logs:      logs,
+		Stable:    logs,
+		Snapshots: snapshots,
+		Limits:    limits,
+		Journal:   journal,
+	}, store)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+	node.logs = logs
+	return node, nil
+}
+
+// Bootstrap makes peers, node IDs mapped to their raft addresses, the members
+// of a new cluster. Every node can be bootstrapped with the same peers, and it
+// does nothing on a node that already belongs to a cluster.
+func (n *ClusterNode) Bootstrap(peers map[string]string) error {
+	var servers []raft.Server
+	for id, addr := range peers {
+		servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(addr)})
+	}
+	err := n.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if err == raft.ErrCantBootstrap {
+		return nil
+	}
+	return err
+}
+
+// Leader returns the ID of the current leader, or an empty string if there's
+// none
+func (n *ClusterNode) Leader() string {
+	_, id := n.raft.LeaderWithID()
+	return string(id)
+}
+
+// IsLeader returns true if the node thinks it's the leader
+func (n *ClusterNode) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Shutdown stops the node, and closes the raft log if the node was opened with
+// OpenClusterNode. The store is left as it is.
+func (n *ClusterNode) Shutdown() error {
+	err := n.raft.Shutdown().Error()
+	if n.logs != nil {
+		if closeErr := n.logs.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Index commits pkg to the cluster, see Worker.Index
+func (n *ClusterNode) Index(pkg *Package) error {
+	res, err := n.apply(Mutation{Command: CmdIndex, Package: pkg.name, Dependencies: pkg.dependencies})
+	if err != nil {
+		return err
+	}
+	err, _ = res.(error)
+	return err
+}
+
+// Remove commits the removal of name to the cluster, see Worker.Remove
+func (n *ClusterNode) Remove(name string) (bool, error) {
+	res, err := n.apply(Mutation{Command: CmdRemove, Package: name})
+	if err != nil {
+		return false, err
+	}
+	if err, ok := res.(error); ok {
+		return false, err
+	}
+	return res.(bool), nil
+}
+
+// Query returns true if name is indexed. Only the leader answers.
+func (n *ClusterNode) Query(name string) (bool, error) {
+	if err := n.verifyLeader(); err != nil {
+		return false, err
+	}
+	return n.worker.Query(name), nil
+}
+
+// Get returns the package called name, or false if it isn't indexed. Only the
+// leader answers.
+func (n *ClusterNode) Get(name string) (*Package, bool, error) {
+	if err := n.verifyLeader(); err != nil {
+		return nil, false, err
+	}
+	pkg, ok := n.worker.Get(name)
+	return pkg, ok, nil
+}
+
+// apply commits m to the raft log and returns the result of applying it
+func (n *ClusterNode) apply(m Mutation) (interface{}, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	f := n.raft.Apply(data, clusterApplyTimeout)
+	if err := f.Error(); err != nil {
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			// INDEX and REMOVE can safely be retried on the new leader
+			return nil, ErrNotLeader
+		}
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+// verifyLeader returns nil if the node is the leader and its store has every
+// mutation committed so far. A new leader may not have applied everything its
+// predecessors committed, so the first read of each term waits for a barrier.
+func (n *ClusterNode) verifyLeader() error {
+	term := n.raft.CurrentTerm()
+	if atomic.LoadUint64(&n.readyTerm) != term {
+		if err := n.raft.Barrier(clusterApplyTimeout).Error(); err != nil {
+			return ErrNotLeader
+		}
+		atomic.StoreUint64(&n.readyTerm, term)
+	}
+	if err := n.raft.VerifyLeader().Error(); err != nil {
+		return ErrNotLeader
+	}
+	if n.raft.CurrentTerm() != term {
+		// leadership changed hands in the meantime
+		return ErrNotLeader
+	}
+	return nil
+}
+
+// clusterFSM applies committed mutations to a store. Every node applies the
+// same mutations in the same order, so they all end up with the same packages
+// and the same result for each mutation.
+type clusterFSM struct {
+	store  PackageStore
+	worker *Worker
+}
+
+// Apply returns the error from Worker.Index for INDEX, and the result of
+// Worker.Remove for REMOVE
+func (f *clusterFSM) Apply(l *raft.Log) interface{} {
+	var m Mutation
+	if err := json.Unmarshal(l.Data, &m); err != nil {
+		return fmt.Errorf("invalid log entry %d: %s", l.Index, err.Error())
+	}
+	switch m.Command {
+	case CmdIndex:
+		return f.worker.Index(NewPackage(m.Package, m.Dependencies))
+	case CmdRemove:
+		return f.worker.Remove(m.Package)
+	}
+	return fmt.Errorf("unknown command %s", m.Command)
+}
+
+// Snapshot writes the store to memory, raft doesn't apply anything while it
+// runs
+func (f *clusterFSM) Snapshot() (raft.FSMSnapshot, error) {
+	var buf bytes.Buffer
+	err := f.store.View(func(tx ReadTx) error {
+		return WriteSnapshot(&buf, tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return clusterSnapshot(buf.Bytes()), nil
+}
+
+// Restore replaces the store with a snapshot taken by Snapshot, journaling a
+// RESET so that change feeds know to start over
+func (f *clusterFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	restored, err := readConsistentSnapshot(rc)
+	if err != nil {
+		return err
+	}
+	return f.store.Update(func(tx WriteTx) error {
+		replaceAll(tx, restored)
+		f.worker.record(Mutation{Command: CmdReset})
+		return nil
+	})
+}
+
+// clusterSnapshot is a snapshot in the format of WriteSnapshot
+type clusterSnapshot []byte
+
+func (s clusterSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s clusterSnapshot) Release() {}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// startCluster starts n nodes talking over in-memory transports, with timeouts
+// short enough for tests
+func startCluster(t *testing.T, n int) []*ClusterNode {
+	conf := raft.DefaultConfig()
+	conf.HeartbeatTimeout = 50 * time.Millisecond
+	conf.ElectionTimeout = 50 * time.Millisecond
+	conf.LeaderLeaseTimeout = 50 * time.Millisecond
+	conf.CommitTimeout = 5 * time.Millisecond
+	conf.LogOutput = ioutil.Discard
+
+	peers := make(map[string]string)
+	transports := make([]*raft.InmemTransport, n)
+	for i := range transports {
+		addr, transport := raft.NewInmemTransport("")
+		transports[i] = transport
+		peers[fmt.Sprintf("node-%d", i)] = string(addr)
+	}
+	for _, a := range transports {
+		for _, b := range transports {
+			a.Connect(b.LocalAddr(), b)
+		}
+	}
+
+	nodes := make([]*ClusterNode, n)
+	for i := range nodes {
+		logs := raft.NewInmemStore()
+		node, err := NewClusterNode(ClusterConfig{
+			ID:        fmt.Sprintf("node-%d", i),
+			Transport: transports[i],
+			Logs:      logs,
+			Stable:    logs,
+			Snapshots: raft.NewInmemSnapshotStore(),
+			Raft:      conf,
+		}, NewMapStore())
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+		t.Cleanup(func() { node.Shutdown() })
+	}
+	if err := nodes[0].Bootstrap(peers); err != nil {
+		t.Fatal(err)
+	}
+	return nodes
+}
+
+// waitForLeader returns the leader elected among nodes
+func waitForLeader(t *testing.T, nodes []*ClusterNode) *ClusterNode {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+// waitForPackages waits until every node has exactly the given packages
+func waitForPackages(t *testing.T, nodes []*ClusterNode, names ...string) {
+	sort.Strings(names)
+	expected := strings.Join(names, " ")
+	deadline := time.Now().Add(10 * time.Second)
+	for _, n := range nodes {
+		for {
+			var indexed []string
+			n.store.View(func(tx ReadTx) error {
+				tx.ForEach(func(pkg *Package) bool {
+					indexed = append(indexed, pkg.name)
+					return true
+				})
+				return nil
+			})
+			sort.Strings(indexed)
+			actual := strings.Join(indexed, " ")
+			if actual == expected {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected [%s] on every node, got [%s]", expected, actual)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func others(nodes []*ClusterNode, leader *ClusterNode) []*ClusterNode {
+	var rest []*ClusterNode
+	for _, n := range nodes {
+		if n != leader {
+			rest = append(rest, n)
+		}
+	}
+	return rest
+}
+
+// Testing that mutations committed on the leader are applied everywhere, and
+// that only the leader serves requests
+func TestCluster(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	if err := leader.Index(NewPackage("a", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Index(NewPackage("b", []string{"a"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Index(NewPackage("c", []string{"missing"})); err != ErrMissingDependency {
+		t.Errorf("expected %v, got %v", ErrMissingDependency, err)
+	}
+	if removed, err := leader.Remove("a"); err != nil || removed {
+		t.Errorf("expected a to be kept for b, got %t %v", removed, err)
+	}
+	if found, err := leader.Query("b"); err != nil || !found {
+		t.Errorf("expected b on the leader, got %t %v", found, err)
+	}
+	waitForPackages(t, nodes, "a", "b")
+
+	for _, n := range others(nodes, leader) {
+		if err := n.Index(NewPackage("d", nil)); err != ErrNotLeader {
+			t.Errorf("expected %v indexing on a follower, got %v", ErrNotLeader, err)
+		}
+		if _, err := n.Query("a"); err != ErrNotLeader {
+			t.Errorf("expected %v querying a follower, got %v", ErrNotLeader, err)
+		}
+		if n.Leader() != leader.Leader() {
+			t.Errorf("expected nodes to agree on the leader, got %s and %s", n.Leader(), leader.Leader())
+		}
+	}
+
+	if removed, err := leader.Remove("b"); err != nil || !removed {
+		t.Errorf("expected b to be removed, got %t %v", removed, err)
+	}
+	waitForPackages(t, nodes, "a")
+}
+
+// Testing that another node takes over when the leader goes away, with
+// everything the old leader acknowledged
+func TestClusterFailover(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+
+	for i := 0; i < 10; i++ {
+		if err := leader.Index(NewPackage(fmt.Sprintf("pkg-%d", i), nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	rest := others(nodes, leader)
+	next := waitForLeader(t, rest)
+	for i := 0; i < 10; i++ {
+		found, err := next.Query(fmt.Sprintf("pkg-%d", i))
+		if err != nil || !found {
+			t.Errorf("expected pkg-%d on the new leader, got %t %v", i, found, err)
+		}
+	}
+	if err := next.Index(NewPackage("after", []string{"pkg-0"})); err != nil {
+		t.Fatal(err)
+	}
+	waitForPackages(t, rest, "after", "pkg-0", "pkg-1", "pkg-2", "pkg-3", "pkg-4", "pkg-5", "pkg-6", "pkg-7", "pkg-8", "pkg-9")
+}
+
+// Testing that a cluster snapshot restores the same packages, and journals a
+// RESET
+func TestClusterSnapshot(t *testing.T) {
+	store := NewMapStore()
+	fsm := &clusterFSM{store: store, worker: NewWorker(store)}
+	fsm.worker.Index(NewPackage("a", nil))
+	fsm.worker.Index(NewPackage("b", []string{"a"}))
+
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &bufferSink{}
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := NewJournal(10)
+	restored := &clusterFSM{store: NewMapStore()}
+	restored.worker = &Worker{store: restored.store, journal: journal}
+	restored.store.Update(func(tx WriteTx) error {
+		tx.Put(NewPackage("stale", nil))
+		return nil
+	})
+	if err := restored.Restore(ioutil.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	w := NewWorker(restored.store)
+	if !w.Query("a") || !w.Query("b") || w.Query("stale") {
+		t.Error("expected the restored store to hold exactly a and b")
+	}
+	if pkg, _ := w.Get("a"); len(pkg.Dependents()) != 1 {
+		t.Errorf("expected b to depend on a, got %v", pkg.Dependents())
+	}
+	// change feeds learn that the store was replaced
+	if events, _ := journal.since(1, 10); len(events) != 1 || events[0].Command != CmdReset {
+		t.Errorf("expected a RESET to be journaled, got %v", events)
+	}
+}
+
+// Testing the line protocol on cluster nodes
+func TestClusterCommands(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	send := serveWorker(t, &Worker{store: leader.store, cluster: leader})
+	follower := serveWorker(t, &Worker{store: others(nodes, leader)[0].store, cluster: others(nodes, leader)[0]})
+
+	tests := []struct {
+		send     func(string) string
+		request  string
+		expected string
+	}{
+		{send, "INDEX|a|", ResponseOK},
+		{send, "INDEX|b|c", ResponseFail},
+		{send, "QUERY|a|", ResponseOK},
+		{send, "QUERY|b|", ResponseFail},
+		{send, "FSCK|repair|", ResponseError},
+		{send, "FSCK|check|", ResponseOK},
+		{follower, "INDEX|c|", ResponseError},
+		{follower, "QUERY|a|", ResponseError},
+		{follower, "REMOVE|a|", ResponseError},
+		{send, "REMOVE|a|", ResponseOK},
+		{send, "QUERY|a|", ResponseFail},
+	}
+	for _, test := range tests {
+		if actual := test.send(test.request); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, actual)
+		}
+	}
+}
+
+// Testing that a node opened on disk lets go of its raft log on shutdown, so
+// that it can be opened again
+func TestOpenClusterNode(t *testing.T) {
+	dir := tempDir(t)
+	for i := 0; i < 2; i++ {
+		opened := make(chan error, 1)
+		go func() {
+			node, err := OpenClusterNode("node-0", "127.0.0.1:0", dir, NewMapStore(), Limits{}, nil)
+			if err == nil {
+				err = node.Shutdown()
+			}
+			opened <- err
+		}()
+		select {
+		case err := <-opened:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the raft log to be closed by the previous node")
+		}
+	}
+}
+
+// bufferSink is a raft.SnapshotSink keeping the snapshot in memory
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "buffer" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
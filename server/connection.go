@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrRequestTooLong is returned for requests longer than the connection limits
+// allow
+var ErrRequestTooLong = errors.New("request too long")
+
+// errIdle is returned when a connection sends nothing for the idle timeout.
+// Nothing is waiting for an answer then, so the connection is closed without
+// one, or a pooled client would take it for the answer to its next request.
+var errIdle = errors.New("idle for too long")
+
+// ConnectionLimits bounds how long clients can keep a worker waiting and how
+// much they can send it at once. A limit of 0 means no limit.
+type ConnectionLimits struct {
+	// how long a connection can wait between requests
+	IdleTimeout time.Duration
+	// how long a client can take to send the rest of a request once it started
+	ReadTimeout time.Duration
+	// how long a client can take to take a response
+	WriteTimeout time.Duration
+	// length in bytes of a request, the newline included
+	MaxRequestLength int
+}
+
+// readRequest reads the next request from r, reading from conn. It waits up to
+// the idle timeout for the request to start, and then up to the read timeout
+// for the rest of it. A request over the length limit isn't read any further.
+func (l ConnectionLimits) readRequest(conn net.Conn, r *bufio.Reader) (string, error) {
+	setReadDeadline(conn, l.IdleTimeout)
+	if _, err := r.Peek(1); err != nil {
+		if isTimeout(err) {
+			return "", errIdle
+		}
+		return "", err
+	}
+	setReadDeadline(conn, l.ReadTimeout)
+
+	var request []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if l.MaxRequestLength > 0 && len(request)+len(chunk) > l.MaxRequestLength {
+			return "", ErrRequestTooLong
+		}
+		request = append(request, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(request), err
+		}
+	}
+}
+
+// writer returns conn with every write bounded by the write timeout
+func (l ConnectionLimits) writer(conn net.Conn) net.Conn {
+	if l.WriteTimeout == 0 {
+		return conn
+	}
+	return &writeTimeoutConn{Conn: conn, timeout: l.WriteTimeout}
+}
+
+// writeTimeoutConn closes the connection when a client doesn't take what is
+// written to it in time, so that the worker can move on
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(b)
+	if isTimeout(err) {
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// setReadDeadline makes reads from conn fail after timeout, or never with 0
+func setReadDeadline(conn net.Conn, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetReadDeadline(deadline)
+}
+
+// isTimeout returns true if err comes from a deadline passing
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Testing that slow and long-winded clients are answered with ERROR and cut
+// off, idle ones are cut off without an answer, and well-behaved ones aren't
+func TestConnectionLimits(t *testing.T) {
+	limits := ConnectionLimits{
+		IdleTimeout:      300 * time.Millisecond,
+		ReadTimeout:      100 * time.Millisecond,
+		MaxRequestLength: 5000,
+	}
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithConnectionLimits(limits))
+	addr, _ := startIndexer(t, p)
+
+	tests := []struct {
+		name    string
+		request string
+		// how long to wait before sending the request
+		delay time.Duration
+		// true if the request is sent without its newline
+		partial  bool
+		expected string
+	}{
+		{"requests", "INDEX|a|", 0, false, ResponseOK},
+		{"long requests", "INDEX|" + strings.Repeat("b", 4000) + "|a", 0, false, ResponseOK},
+		{"requests after a while", "QUERY|a|", 100 * time.Millisecond, false, ResponseOK},
+		{"idle connections", "", 0, true, ""},
+		{"slow requests", "QUERY|a", 0, true, ResponseError},
+		{"requests over the length limit", "INDEX|" + strings.Repeat("c", 5000) + "|", 0, false, ResponseError},
+	}
+	for _, test := range tests {
+		conn := dialIndexer(t, addr)
+		time.Sleep(test.delay)
+		if test.partial {
+			conn.Write([]byte(test.request))
+		} else {
+			conn.send(t, test.request)
+		}
+		response, err := conn.receive()
+		if response != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, response)
+		}
+		if test.expected == "" && err != io.EOF {
+			t.Errorf("%s: expected the connection to be closed, got %v", test.name, err)
+		}
+		if test.expected != ResponseError {
+			continue
+		}
+		if _, err := conn.receive(); err == nil {
+			t.Errorf("%s: expected the connection to be closed", test.name)
+		}
+	}
+
+	// requests sent together are all read
+	conn := dialIndexer(t, addr)
+	conn.send(t, "QUERY|a|\nQUERY|b|\nQUERY|a|")
+	for _, expected := range []string{ResponseOK, ResponseFail, ResponseOK} {
+		if response, _ := conn.receive(); response != expected {
+			t.Errorf("pipelined requests: expected %s, got %s", expected, response)
+		}
+	}
+}
+
+// Testing that a client that doesn't read its responses is cut off
+func TestWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	w := &Worker{store: NewMapStore(), connLimits: ConnectionLimits{WriteTimeout: 100 * time.Millisecond}}
+	done := make(chan struct{})
+	go func() {
+		w.handleRequest(server)
+		close(done)
+	}()
+
+	// net.Pipe has no buffer, so the response can't be written until it's read
+	client.Write([]byte("QUERY|a|\n"))
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,572 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The digest of a store is a Merkle tree. Packages are placed in leaves by the
+// first DigestDepth hex digits of the sha256 of their name, and each node is
+// addressed by the hex digits leading to it, the root by none. A leaf's hash
+// covers the names and dependencies of its packages in name order, and an
+// inner node's hash the hashes of its 16 children, so two stores with the same
+// root hash hold the same packages, and a difference can be tracked down to
+// the leaves holding it by following the children whose hashes differ.
+const (
+	DigestDepth = 4
+	// the root in the DIGEST command, which needs a non empty path
+	DigestRoot = "/"
+
+	digestFanout = 16
+)
+
+// DigestNode is a node of the digest of a store
+type DigestNode struct {
+	Path string
+	Hash string
+	// the hashes of the children of an inner node
+	Children []string
+	// the packages in a leaf, sorted by name
+	Packages []*Package
+}
+
+// IsLeaf returns true if the node holds packages rather than children
+func (n *DigestNode) IsLeaf() bool {
+	return len(n.Path) == DigestDepth
+}
+
+// DigestSource is anything that can compute the digest of a store, locally or
+// over the network
+type DigestSource interface {
+	Digest(path string) (*DigestNode, error)
+}
+
+// Digest returns the node at path of the digest of the store. The digest is
+// worked out once and kept until the store changes, if the store counts its
+// changes, see GenerationStore.
+func (w *Worker) Digest(path string) (*DigestNode, error) {
+	if err := checkDigestPath(path); err != nil {
+		return nil, err
+	}
+	tree, err := w.digests.get(w.store)
+	if err != nil {
+		return nil, err
+	}
+	return tree.node(path), nil
+}
+
+// Digest returns the node at path of the digest of the packages in tx
+func Digest(tx ReadTx, path string) (*DigestNode, error) {
+	if err := checkDigestPath(path); err != nil {
+		return nil, err
+	}
+	return newDigestTree(tx).node(path), nil
+}
+
+// digestCache keeps the digest of a store until the store changes
+type digestCache struct {
+	l sync.Mutex
+	// the digest, and the generation of the store it was worked out at
+	tree       *digestTree
+	generation uint64
+}
+
+// get returns the digest of store. A nil cache, or a store that doesn't count
+// its changes, has it worked out every time.
+func (c *digestCache) get(store PackageStore) (*digestTree, error) {
+	var tree *digestTree
+	gs, ok := store.(GenerationStore)
+	if c == nil || !ok {
+		err := store.View(func(tx ReadTx) error {
+			tree = newDigestTree(tx)
+			return nil
+		})
+		return tree, err
+	}
+
+	// requests for the digest while it is worked out wait for it
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.tree != nil && c.generation == gs.Generation() {
+		return c.tree, nil
+	}
+	var generation uint64
+	err := consistentView(store, func() { generation = gs.Generation() }, func(tx ReadTx) error {
+		tree = newDigestTree(tx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.tree, c.generation = tree, generation
+	return tree, nil
+}
+
+// digestTree is the whole digest of a store. Only the nodes with packages
+// under them are kept, the others have the hash of an empty node.
+type digestTree struct {
+	// the packages in every leaf, sorted by name
+	leaves map[string][]*Package
+	hashes map[string][]byte
+}
+
+// emptyDigest holds the hash of a node with no packages under it for every
+// depth, the root's first
+var emptyDigest = func() [DigestDepth + 1][]byte {
+	var empty [DigestDepth + 1][]byte
+	leaf := sha256.Sum256(nil)
+	empty[DigestDepth] = leaf[:]
+	for depth := DigestDepth - 1; depth >= 0; depth-- {
+		h := sha256.New()
+		for i := 0; i < digestFanout; i++ {
+			h.Write(empty[depth+1])
+		}
+		empty[depth] = h.Sum(nil)
+	}
+	return empty
+}()
+
+// newDigestTree works out the digest of the packages in tx
+func newDigestTree(tx ReadTx) *digestTree {
+	t := &digestTree{leaves: make(map[string][]*Package), hashes: make(map[string][]byte)}
+	tx.ForEach(func(pkg *Package) bool {
+		path := digestPath(pkg.name)
+		t.leaves[path] = append(t.leaves[path], pkg)
+		return true
+	})
+
+	// the nodes at each depth with packages under them
+	paths := make([]string, 0, len(t.leaves))
+	for path, pkgs := range t.leaves {
+		sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].name < pkgs[j].name })
+		h := sha256.New()
+		for _, pkg := range pkgs {
+			h.Write(packageDigest(pkg))
+		}
+		t.hashes[path] = h.Sum(nil)
+		paths = append(paths, path)
+	}
+	for depth := DigestDepth - 1; depth >= 0; depth-- {
+		parents := make(map[string]bool)
+		for _, path := range paths {
+			parents[path[:depth]] = true
+		}
+		paths = paths[:0]
+		for parent := range parents {
+			h := sha256.New()
+			for _, child := range t.children(parent) {
+				h.Write(child)
+			}
+			t.hashes[parent] = h.Sum(nil)
+			paths = append(paths, parent)
+		}
+	}
+	return t
+}
+
+// hash returns the hash of the node at path
+func (t *digestTree) hash(path string) []byte {
+	if h, ok := t.hashes[path]; ok {
+		return h
+	}
+	return emptyDigest[len(path)]
+}
+
+// children returns the hashes of the children of the inner node at path
+func (t *digestTree) children(path string) [][]byte {
+	children := make([][]byte, digestFanout)
+	for i := range children {
+		children[i] = t.hash(path + digestDigits[i:i+1])
+	}
+	return children
+}
+
+// node returns the node at path, which must be valid
+func (t *digestTree) node(path string) *DigestNode {
+	node := &DigestNode{Path: path, Hash: hex.EncodeToString(t.hash(path))}
+	if node.IsLeaf() {
+		node.Packages = t.leaves[path]
+		return node
+	}
+	for _, child := range t.children(path) {
+		node.Children = append(node.Children, hex.EncodeToString(child))
+	}
+	return node
+}
+
+const digestDigits = "0123456789abcdef"
+
+// digestPath returns the path of the leaf the package called name goes in
+func digestPath(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:DigestDepth]
+}
+
+// packageDigest returns the hash of the name and dependencies of pkg. The
+// order dependencies were given in doesn't matter, and dependents are left
+// out as they follow from the dependencies of other packages.
+func packageDigest(pkg *Package) []byte {
+	deps := append([]string(nil), pkg.dependencies...)
+	sort.Strings(deps)
+	h := sha256.New()
+	h.Write([]byte(pkg.name))
+	for _, dep := range deps {
+		h.Write([]byte{0})
+		h.Write([]byte(dep))
+	}
+	return h.Sum(nil)
+}
+
+func checkDigestPath(path string) error {
+	if len(path) > DigestDepth {
+		return fmt.Errorf("invalid digest path %q", path)
+	}
+	for _, c := range path {
+		if !strings.ContainsRune(digestDigits, c) {
+			return fmt.Errorf("invalid digest path %q", path)
+		}
+	}
+	return nil
+}
+
+// Difference is a package that isn't the same in two stores
+type Difference struct {
+	Name string
+	// the package in each store, nil if it isn't there
+	Source *Package
+	Target *Package
+}
+
+func (d Difference) String() string {
+	switch {
+	case d.Target == nil:
+		return fmt.Sprintf("missing %s", d.Name)
+	case d.Source == nil:
+		return fmt.Sprintf("extra %s", d.Name)
+	}
+	return fmt.Sprintf("different %s: dependencies %v, expected %v", d.Name, d.Target.dependencies, d.Source.dependencies)
+}
+
+// Compare returns every package that isn't the same in source and target,
+// sorted by name. Only the parts of the digests that differ are fetched.
+func Compare(source, target DigestSource) ([]Difference, error) {
+	var differences []Difference
+	var compare func(path string) error
+	compare = func(path string) error {
+		s, err := source.Digest(path)
+		if err != nil {
+			return err
+		}
+		t, err := target.Digest(path)
+		if err != nil {
+			return err
+		}
+		if s.Hash == t.Hash {
+			return nil
+		}
+		if s.IsLeaf() {
+			differences = append(differences, compareLeaves(s, t)...)
+			return nil
+		}
+		for i := range s.Children {
+			if i < len(t.Children) && s.Children[i] == t.Children[i] {
+				continue
+			}
+			if err := compare(path + digestDigits[i:i+1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := compare(""); err != nil {
+		return nil, err
+	}
+	sort.Slice(differences, func(i, j int) bool { return differences[i].Name < differences[j].Name })
+	return differences, nil
+}
+
+func compareLeaves(s, t *DigestNode) []Difference {
+	byName := make(map[string]*Difference)
+	var differences []Difference
+	for _, pkg := range s.Packages {
+		byName[pkg.name] = &Difference{Name: pkg.name, Source: pkg}
+	}
+	for _, pkg := range t.Packages {
+		d, ok := byName[pkg.name]
+		if !ok {
+			differences = append(differences, Difference{Name: pkg.name, Target: pkg})
+			continue
+		}
+		if bytes.Equal(packageDigest(d.Source), packageDigest(pkg)) {
+			delete(byName, pkg.name)
+			continue
+		}
+		d.Target = pkg
+	}
+	for _, d := range byName {
+		differences = append(differences, *d)
+	}
+	return differences
+}
+
+// ReconcileRequests returns the requests that make target the same as source,
+// given their differences. Packages that are extra or different in target are
+// removed first, together with whatever depends on them there, dependents
+// first. Then everything that is missing is indexed again from source,
+// dependencies first.
+func ReconcileRequests(source, target DigestSource, differences []Difference) ([]string, error) {
+	sourcePkgs := &digestLookup{source: source, leaves: make(map[string]*DigestNode)}
+	targetPkgs := &digestLookup{source: target, leaves: make(map[string]*DigestNode)}
+
+	// everything in target that has to go, and what depends on it
+	remove := make(map[string]*Package)
+	var queue []*Package
+	for _, d := range differences {
+		if d.Target != nil {
+			remove[d.Name] = d.Target
+			queue = append(queue, d.Target)
+		}
+	}
+	for len(queue) > 0 {
+		pkg := queue[0]
+		queue = queue[1:]
+		for _, name := range pkg.Dependents() {
+			if _, ok := remove[name]; ok {
+				continue
+			}
+			dependent, err := targetPkgs.get(name)
+			if err != nil {
+				return nil, err
+			}
+			if dependent == nil {
+				return nil, fmt.Errorf("target is inconsistent, %s depends on %s but is missing", name, pkg.name)
+			}
+			remove[name] = dependent
+			queue = append(queue, dependent)
+		}
+	}
+
+	// everything source has that target is missing, or will be
+	index := make(map[string]*Package)
+	for _, d := range differences {
+		if d.Source != nil {
+			index[d.Name] = d.Source
+		}
+	}
+	for name := range remove {
+		if _, ok := index[name]; ok {
+			continue
+		}
+		pkg, err := sourcePkgs.get(name)
+		if err != nil {
+			return nil, err
+		}
+		if pkg != nil {
+			index[name] = pkg
+		}
+	}
+
+	var requests []string
+	removals := dependenciesFirst(remove)
+	for i := len(removals) - 1; i >= 0; i-- {
+		requests = append(requests, fmt.Sprintf("%s|%s|", CmdRemove, removals[i].name))
+	}
+	for _, pkg := range dependenciesFirst(index) {
+		requests = append(requests, fmt.Sprintf("%s|%s|%s", CmdIndex, pkg.name, strings.Join(pkg.dependencies, ",")))
+	}
+	return requests, nil
+}
+
+// dependenciesFirst returns pkgs sorted so that each package comes after those
+// of its dependencies that are also in pkgs, ties broken by name
+func dependenciesFirst(pkgs map[string]*Package) []*Package {
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	done := make(map[string]bool, len(pkgs))
+	order := make([]*Package, 0, len(pkgs))
+	var visit func(name string)
+	visit = func(name string) {
+		pkg, ok := pkgs[name]
+		if !ok || done[name] {
+			return
+		}
+		done[name] = true
+		for _, dep := range pkg.dependencies {
+			visit(dep)
+		}
+		order = append(order, pkg)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return order
+}
+
+// digestLookup finds single packages through the leaves of a digest
+type digestLookup struct {
+	source DigestSource
+	leaves map[string]*DigestNode
+}
+
+// get returns the package called name, or nil if there's none
+func (l *digestLookup) get(name string) (*Package, error) {
+	path := digestPath(name)
+	leaf, ok := l.leaves[path]
+	if !ok {
+		var err error
+		leaf, err = l.source.Digest(path)
+		if err != nil {
+			return nil, err
+		}
+		l.leaves[path] = leaf
+	}
+	for _, pkg := range leaf.Packages {
+		if pkg.name == name {
+			return pkg, nil
+		}
+	}
+	return nil, nil
+}
+
+// formatDigest returns the DIGEST response for node: the hash of the node
+// followed by the hashes of its children, or for a leaf by its packages, each
+// as name:dependencies:dependents with every name escaped
+func formatDigest(node *DigestNode) string {
+	fields := []string{ResponseOK, node.Hash}
+	if !node.IsLeaf() {
+		fields = append(fields, node.Children...)
+		return strings.Join(fields, " ")
+	}
+	for _, pkg := range node.Packages {
+		fields = append(fields, formatPackage(pkg))
+	}
+	return strings.Join(fields, " ")
+}
+
+// formatPackage returns pkg as name:dependencies:dependents with every name
+// escaped, as DIGEST and FETCH list packages
+func formatPackage(pkg *Package) string {
+	return strings.Join([]string{
+		url.QueryEscape(pkg.name),
+		escapeNames(pkg.dependencies),
+		escapeNames(pkg.Dependents()),
+	}, ":")
+}
+
+// parsePackage parses a package formatted by formatPackage
+func parsePackage(field string) (*Package, error) {
+	parts := strings.Split(field, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid package %s", field)
+	}
+	name, err := url.QueryUnescape(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	deps, err := unescapeNames(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	dependents, err := unescapeNames(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return NewPackageWithDependents(name, deps, dependents), nil
+}
+
+// formatFetch returns the FETCH response for pkgs, a package and everything it
+// depends on: OK followed by the packages, formatted like in DIGEST
+func formatFetch(pkgs []*Package) string {
+	fields := []string{ResponseOK}
+	for _, pkg := range pkgs {
+		fields = append(fields, formatPackage(pkg))
+	}
+	return strings.Join(fields, " ")
+}
+
+// fetchRequest returns the FETCH request for the package called name
+func fetchRequest(name string) string {
+	return fmt.Sprintf("%s|%s|", CmdFetch, name)
+}
+
+// parseFetch parses a FETCH response for the package called name, and returns
+// false if the indexer doesn't have it
+func parseFetch(name, response string) ([]*Package, bool, error) {
+	if response == ResponseFail {
+		return nil, false, nil
+	}
+	fields := strings.Fields(response)
+	if len(fields) < 2 || fields[0] != ResponseOK {
+		return nil, false, fmt.Errorf("FETCH %s failed: %s", name, response)
+	}
+	pkgs := make([]*Package, 0, len(fields)-1)
+	for _, field := range fields[1:] {
+		pkg, err := parsePackage(field)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid FETCH response for %s: %s", name, err.Error())
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, true, nil
+}
+
+// digestRequest returns the DIGEST request for the node at path
+func digestRequest(path string) string {
+	return fmt.Sprintf("%s|%s%s|", CmdDigest, DigestRoot, path)
+}
+
+// parseDigest parses a DIGEST response for the node at path
+func parseDigest(path, response string) (*DigestNode, error) {
+	fields := strings.Fields(response)
+	if len(fields) < 2 || fields[0] != ResponseOK {
+		return nil, fmt.Errorf("DIGEST %s failed: %s", path, response)
+	}
+	node := &DigestNode{Path: path, Hash: fields[1]}
+	if !node.IsLeaf() {
+		if len(fields) != 2+digestFanout {
+			return nil, fmt.Errorf("invalid DIGEST response for %s: %s", path, response)
+		}
+		node.Children = fields[2:]
+		return node, nil
+	}
+	for _, field := range fields[2:] {
+		pkg, err := parsePackage(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DIGEST response for %s: %s", path, err.Error())
+		}
+		node.Packages = append(node.Packages, pkg)
+	}
+	return node, nil
+}
+
+func escapeNames(names []string) string {
+	escaped := make([]string, len(names))
+	for i, name := range names {
+		escaped[i] = url.QueryEscape(name)
+	}
+	return strings.Join(escaped, ",")
+}
+
+func unescapeNames(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	names := strings.Split(s, ",")
+	for i, name := range names {
+		var err error
+		if names[i], err = url.QueryUnescape(name); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Testing that stores with the same packages have the same digest, whatever
+// the store and the order packages were indexed in
+func TestDigest(t *testing.T) {
+	a := NewWorker(NewMapStore())
+	a.Index(NewPackage("a", nil))
+	a.Index(NewPackage("b", nil))
+	a.Index(NewPackage("c", []string{"a", "b"}))
+
+	interned, _ := NewStore(StoreInterned)
+	b := NewWorker(interned)
+	b.Index(NewPackage("b", nil))
+	b.Index(NewPackage("a", nil))
+	b.Index(NewPackage("c", []string{"b", "a"}))
+
+	rootA, err := a.Digest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootB, err := b.Digest("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootA.Hash != rootB.Hash || !reflect.DeepEqual(rootA.Children, rootB.Children) {
+		t.Errorf("expected the same digest, got %s and %s", rootA.Hash, rootB.Hash)
+	}
+	if len(rootA.Children) != digestFanout {
+		t.Errorf("expected %d children, got %d", digestFanout, len(rootA.Children))
+	}
+
+	leaf, err := a.Digest(digestPath("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaf.IsLeaf() || len(leaf.Packages) == 0 {
+		t.Fatalf("expected a leaf holding c, got %+v", leaf)
+	}
+
+	b.Remove("c")
+	if rootB, _ = b.Digest(""); rootA.Hash == rootB.Hash {
+		t.Error("expected the digest to change with the packages")
+	}
+
+	for _, path := range []string{"g", "00000", "A"} {
+		if _, err := a.Digest(path); err == nil {
+			t.Errorf("expected %q to be refused", path)
+		}
+	}
+}
+
+// Testing that the digest is worked out once per change to the store, on every
+// store
+func TestDigestCache(t *testing.T) {
+	for _, kind := range []string{StoreMap, StoreSharded, StoreMVCC, StoreInterned} {
+		store, _ := NewStore(kind)
+		w := NewWorker(store)
+		w.Index(NewPackage("a", nil))
+
+		first, _ := w.digests.get(store)
+		if again, _ := w.digests.get(store); again != first {
+			t.Errorf("%s: expected the digest to be kept while the store doesn't change", kind)
+		}
+		w.Index(NewPackage("b", []string{"a"}))
+		changed, _ := w.digests.get(store)
+		if changed == first {
+			t.Errorf("%s: expected the digest to be worked out again after a change", kind)
+		}
+
+		var expected *DigestNode
+		store.View(func(tx ReadTx) error {
+			expected, _ = Digest(tx, "")
+			return nil
+		})
+		if root, _ := w.Digest(""); !reflect.DeepEqual(root, expected) {
+			t.Errorf("%s: expected %+v, got %+v", kind, expected, root)
+		}
+	}
+}
+
+// Testing that every difference is found, and that the repair requests make
+// the target the same as the source
+func TestCompare(t *testing.T) {
+	source := NewWorker(NewMapStore())
+	target := NewWorker(NewMapStore())
+	for i := 0; i < 200; i++ {
+		pkg := fmt.Sprintf("pkg-%d", i)
+		source.Index(NewPackage(pkg, nil))
+		target.Index(NewPackage(pkg, nil))
+	}
+	source.Index(NewPackage("missing", []string{"pkg-1"}))
+	source.Index(NewPackage("different", []string{"pkg-2"}))
+	target.Index(NewPackage("different", []string{"pkg-3"}))
+	target.Index(NewPackage("extra", []string{"different"}))
+	source.Index(NewPackage("same", []string{"different"}))
+	target.Index(NewPackage("same", []string{"different"}))
+
+	differences, err := Compare(source, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, d := range differences {
+		found = append(found, d.String())
+	}
+	expected := []string{
+		"different different: dependencies [pkg-3], expected [pkg-2]",
+		"extra extra",
+		"missing missing",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+
+	requests, err := ReconcileRequests(source, target, differences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := serveWorker(t, target)
+	for _, request := range requests {
+		if response := send(request); response != ResponseOK {
+			t.Errorf("%s: expected %s, got %s", request, ResponseOK, response)
+		}
+	}
+	if differences, _ := Compare(source, target); len(differences) != 0 {
+		t.Errorf("expected no differences after repair, got %v", differences)
+	}
+	if problems := fsck(target); len(problems) != 0 {
+		t.Errorf("expected a consistent target, got %v", problems)
+	}
+}
+
+// Testing DIGEST over the line protocol
+func TestDigestCommand(t *testing.T) {
+	source := NewWorker(NewMapStore())
+	source.Index(NewPackage("a b", nil))
+	source.Index(NewPackage("c:d", []string{"a b"}))
+	target := NewWorker(NewMapStore())
+
+	sourceClient := lineClient(t, source)
+	targetClient := lineClient(t, target)
+	differences, err := Compare(sourceClient, targetClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(differences) != 2 {
+		t.Errorf("expected 2 differences, got %v", differences)
+	}
+
+	leaf, err := sourceClient.Digest(digestPath("c:d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, _ := source.Digest(digestPath("c:d"))
+	if !reflect.DeepEqual(leaf, local) {
+		t.Errorf("expected %+v, got %+v", local, leaf)
+	}
+
+	for _, request := range []string{"DIGEST|0|", "DIGEST|/x|", "DIGEST|/00000|"} {
+		if response, _ := targetClient.Send(request); response != ResponseError {
+			t.Errorf("%s: expected %s, got %s", request, ResponseError, response)
+		}
+	}
+}
+
+func lineClient(t *testing.T, w *Worker) *Client {
+	server, client := net.Pipe()
+	go w.handleRequest(server)
+	t.Cleanup(func() { client.Close() })
+	return &Client{conn: client, reader: bufio.NewReader(client)}
+}
+
+func fsck(w *Worker) []Problem {
+	var problems []Problem
+	w.store.View(func(tx ReadTx) error {
+		problems = Check(tx)
+		return nil
+	})
+	return problems
+}
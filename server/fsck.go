@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// a package depends on a package that isn't in the store
+	ProblemMissingDependency = "missing dependency"
+	// a package is missing from the dependents of one of its dependencies
+	ProblemMissingDependent = "missing dependent"
+	// a package lists a dependent that doesn't depend on it
+	ProblemStaleDependent = "stale dependent"
+)
+
+// Problem is an inconsistency in a PackageStore found by Check
+type Problem struct {
+	Kind    string
+	Package string
+	// the dependency or dependent the problem is about
+	Other string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s %s", p.Package, p.Kind, p.Other)
+}
+
+// Check verifies that every dependency of every package exists, and that the
+// dependencies and dependents of all packages mirror each other exactly. The
+// problems found are sorted by package.
+func Check(tx ReadTx) []Problem {
+	problems := make([]Problem, 0)
+
+	tx.ForEach(func(pkg *Package) bool {
+		for _, dep := range pkg.dependencies {
+			d, ok := tx.Get(dep)
+			if !ok {
+				problems = append(problems, Problem{Kind: ProblemMissingDependency, Package: pkg.name, Other: dep})
+				continue
+			}
+			if _, ok := d.dependents[pkg.name]; !ok {
+				problems = append(problems, Problem{Kind: ProblemMissingDependent, Package: dep, Other: pkg.name})
+			}
+		}
+		for dependent := range pkg.dependents {
+			d, ok := tx.Get(dependent)
+			if !ok || !contains(d.dependencies, pkg.name) {
+				problems = append(problems, Problem{Kind: ProblemStaleDependent, Package: pkg.name, Other: dependent})
+			}
+		}
+		return true
+	})
+
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Package != problems[j].Package {
+			return problems[i].Package < problems[j].Package
+		}
+		if problems[i].Kind != problems[j].Kind {
+			return problems[i].Kind < problems[j].Kind
+		}
+		return problems[i].Other < problems[j].Other
+	})
+	return problems
+}
+
+// Repair rebuilds the dependents of every package from the dependencies of
+// the others, then checks the store again and returns what is left. Missing
+// dependencies can't be repaired, the packages they point to are gone.
+func Repair(tx WriteTx) []Problem {
+	dependents := make(map[string]map[string]interface{})
+	pkgs := make([]*Package, 0, tx.Size())
+	tx.ForEach(func(pkg *Package) bool {
+		pkgs = append(pkgs, pkg)
+		for _, dep := range pkg.dependencies {
+			if dependents[dep] == nil {
+				dependents[dep] = make(map[string]interface{})
+			}
+			dependents[dep][pkg.name] = struct{}{}
+		}
+		return true
+	})
+
+	for _, pkg := range pkgs {
+		want := dependents[pkg.name]
+		if want == nil {
+			want = make(map[string]interface{})
+		}
+		if sameKeys(pkg.dependents, want) {
+			continue
+		}
+		pkg = pkg.copy()
+		pkg.dependents = want
+		tx.Put(pkg)
+	}
+	return Check(tx)
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func sameKeys(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
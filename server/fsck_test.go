@@ -0,0 +1,94 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+// brokenStore returns a store where
+//   - b lists a as a dependent, but a doesn't depend on b
+//   - c depends on a, but a doesn't list c as a dependent
+//   - d depends on z, which doesn't exist
+func brokenStore() *mapStore {
+	m := NewMapStore()
+	m.m["a"] = &Package{name: "a", dependencies: []string{}, dependents: map[string]interface{}{}}
+	m.m["b"] = &Package{name: "b", dependencies: []string{}, dependents: map[string]interface{}{"a": struct{}{}}}
+	m.m["c"] = &Package{name: "c", dependencies: []string{"a"}, dependents: map[string]interface{}{}}
+	m.m["d"] = &Package{name: "d", dependencies: []string{"z"}, dependents: map[string]interface{}{}}
+	return m
+}
+
+// Testing that every kind of inconsistency is found
+func TestCheck(t *testing.T) {
+	expected := []Problem{
+		{Kind: ProblemMissingDependent, Package: "a", Other: "c"},
+		{Kind: ProblemStaleDependent, Package: "b", Other: "a"},
+		{Kind: ProblemMissingDependency, Package: "d", Other: "z"},
+	}
+
+	var problems []Problem
+	brokenStore().View(func(tx ReadTx) error {
+		problems = Check(tx)
+		return nil
+	})
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected %v, got %v", expected, problems)
+	}
+}
+
+// Testing that a consistent store passes the check
+func TestCheckConsistent(t *testing.T) {
+	m := NewMapStore()
+	p := &Worker{store: m}
+	for _, pkg := range testWorkload(100, 4, 1) {
+		p.Add(newPackage(pkg))
+	}
+
+	if !p.Fsck(false) {
+		t.Error("expected no problems")
+	}
+}
+
+// Testing that repair rebuilds reverse edges and leaves missing dependencies
+func TestRepair(t *testing.T) {
+	m := brokenStore()
+	p := &Worker{store: m}
+
+	if p.Fsck(false) {
+		t.Error("expected problems")
+	}
+
+	var problems []Problem
+	m.Update(func(tx WriteTx) error {
+		problems = Repair(tx)
+		return nil
+	})
+	expected := []Problem{{Kind: ProblemMissingDependency, Package: "d", Other: "z"}}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("expected %v, got %v", expected, problems)
+	}
+	if !reflect.DeepEqual(m.m["a"].dependents, map[string]interface{}{"c": struct{}{}}) {
+		t.Errorf("expected c to be a dependent of a, got %v", m.m["a"].dependents)
+	}
+	if len(m.m["b"].dependents) != 0 {
+		t.Errorf("expected b to have no dependents, got %v", m.m["b"].dependents)
+	}
+
+	// with the broken edge gone, a can't be removed and c can
+	if p.Remove("a") || !p.Remove("c") || !p.Remove("a") {
+		t.Error("unexpected remove result after repair")
+	}
+}
+
+// Testing that an inconsistent store fails the request instead of the server
+func TestInconsistentRemove(t *testing.T) {
+	m := brokenStore()
+	p := &Worker{store: m}
+
+	if p.Remove("d") {
+		t.Error("expected removing d to fail, its dependency z is missing")
+	}
+	if _, ok := m.m["d"]; !ok {
+		t.Error("expected d to be rolled back")
+	}
+}
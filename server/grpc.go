@@ -0,0 +1,368 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/john-cai/package-indexer/server/indexerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCServer serves the index as the PackageIndexer service of
+// indexerpb/indexer.proto
+type GRPCServer struct {
+	server  *grpc.Server
+	service *grpcService
+}
+
+// GRPCServer returns a gRPC server for the index, with opts, e.g. grpc.Creds
+// for TLS.
+//
+// Index, Query and Remove go through the same checks as INDEX, QUERY and REMOVE
+// on the line protocol, authenticated with "authorization: Bearer <token>"
+// metadata, and the response they would get there maps to the status code,
+// see grpcError. List and Watch need the reader role, and read the server's
+// own store, for mirrors only what they have cached. Watch needs a journal,
+// see WithJournal.
+func (p *PackageIndexer) GRPCServer(opts ...grpc.ServerOption) *GRPCServer {
+	s := &GRPCServer{
+		server:  grpc.NewServer(opts...),
+		service: &grpcService{worker: p.newWorker(), stop: make(chan struct{})},
+	}
+	indexerpb.RegisterPackageIndexerServer(s.server, s.service)
+	return s
+}
+
+// Serve accepts connections on ln until Shutdown is called, see grpc.Server
+func (s *GRPCServer) Serve(ln net.Listener) error {
+	return s.server.Serve(ln)
+}
+
+// Shutdown stops accepting connections, ends every Watch call and waits for
+// the other calls to finish. Once ctx is done, they are cut off and ctx's
+// error is returned.
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	s.service.stopOnce.Do(func() { close(s.service.stop) })
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
+
+// grpcService implements the generated indexerpb.PackageIndexerServer
+type grpcService struct {
+	indexerpb.UnimplementedPackageIndexerServer
+	worker *Worker
+	// closed on Shutdown, Watch calls would go on forever otherwise
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (g *grpcService) Index(ctx context.Context, req *indexerpb.IndexRequest) (*indexerpb.IndexResponse, error) {
+	s, err := g.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcError(s, g.worker.run(s, CmdIndex, req.GetName(), req.GetDependencies())); err != nil {
+		return nil, err
+	}
+	return &indexerpb.IndexResponse{}, nil
+}
+
+func (g *grpcService) Query(ctx context.Context, req *indexerpb.QueryRequest) (*indexerpb.QueryResponse, error) {
+	s, err := g.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response := g.worker.run(s, CmdQuery, req.GetName(), nil)
+	if response == ResponseFail {
+		return &indexerpb.QueryResponse{}, nil
+	}
+	if err := grpcError(s, response); err != nil {
+		return nil, err
+	}
+	// QUERY brought the package into the store if it wasn't, e.g. on mirrors
+	pkg, ok := g.worker.Get(req.GetName())
+	if !ok {
+		return &indexerpb.QueryResponse{}, nil
+	}
+	return &indexerpb.QueryResponse{Found: true, Package: newPBPackage(pkg)}, nil
+}
+
+func (g *grpcService) Remove(ctx context.Context, req *indexerpb.RemoveRequest) (*indexerpb.RemoveResponse, error) {
+	s, err := g.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcError(s, g.worker.run(s, CmdRemove, req.GetName(), nil)); err != nil {
+		return nil, err
+	}
+	return &indexerpb.RemoveResponse{}, nil
+}
+
+// List sends every package in the store, sorted by name. They are collected
+// first, so that a slow client doesn't hold up writes.
+func (g *grpcService) List(req *indexerpb.ListRequest, stream grpc.ServerStreamingServer[indexerpb.Package]) error {
+	s, err := g.session(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := g.authorizeRead(s); err != nil {
+		return err
+	}
+	var pkgs []*Package
+	err = g.worker.store.View(func(tx ReadTx) error {
+		tx.ForEach(func(pkg *Package) bool {
+			pkgs = append(pkgs, pkg)
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		log.Printf("error listing packages: %s", err.Error())
+		return status.Error(codes.Unavailable, ResponseError)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].name < pkgs[j].name })
+	for _, pkg := range pkgs {
+		if err := stream.Send(newPBPackage(pkg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch sends the mutations recorded in the journal after req.Since, or from
+// now on, until the client goes away. A client that falls further behind than
+// the journal goes gets a RESET event in place of the mutations it missed, like
+// a Feed.
+func (g *grpcService) Watch(req *indexerpb.WatchRequest, stream grpc.ServerStreamingServer[indexerpb.Event]) error {
+	s, err := g.session(stream.Context())
+	if err != nil {
+		return err
+	}
+	if err := g.authorizeRead(s); err != nil {
+		return err
+	}
+	journal := g.worker.journal
+	if journal == nil {
+		return status.Error(codes.FailedPrecondition, "the server keeps no journal")
+	}
+
+	next := req.GetSince() + 1
+	if req.GetSince() == 0 {
+		next = journal.Last() + 1
+	}
+	for {
+		// get the wait channel before reading, so nothing appended in between is missed
+		changed := journal.wait()
+		events, ok := journal.since(next, feedBatch)
+		if !ok {
+			first := journal.First()
+			events = []Mutation{{Seq: first - 1, Time: time.Now().UTC(), Command: CmdReset}}
+		}
+		for _, m := range events {
+			m.Journal = journal.ID()
+			if err := stream.Send(newPBEvent(m)); err != nil {
+				return err
+			}
+			next = m.Seq + 1
+		}
+		if len(events) > 0 {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-g.stop:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+// session returns the session of the client making the call, authenticated
+// with the token in its metadata if there is one
+func (g *grpcService) session(ctx context.Context) (*session, error) {
+	addr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		addr = p.Addr.String()
+	}
+	s := g.worker.newSession(addr)
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("authorization"); len(values) > 0 && g.worker.credentials != nil {
+		if token := strings.TrimPrefix(values[0], "Bearer "); token != "" && !g.worker.authenticate(s, token) {
+			return nil, grpcError(s, ResponseDenied)
+		}
+	}
+	return s, nil
+}
+
+// authorizeRead checks a read of the whole store, that the line protocol has
+// no command for, like it would a QUERY
+func (g *grpcService) authorizeRead(s *session) error {
+	if !g.worker.throttle(s, false) {
+		return grpcError(s, ResponseThrottled)
+	}
+	if !g.worker.permits(s, RoleReader) {
+		log.Printf("refused to read the store to %q, a %s", s.identity.Name, s.identity.Role)
+		return grpcError(s, ResponseDenied)
+	}
+	return nil
+}
+
+// grpcError returns the status for a response of the line protocol, nil for OK.
+// FAIL is a failed precondition, with the package's dependencies or
+// dependents.
+func grpcError(s *session, response string) error {
+	code := codes.Unavailable
+	switch response {
+	case ResponseOK:
+		return nil
+	case ResponseFail:
+		code = codes.FailedPrecondition
+	case ResponseQuota, ResponseThrottled:
+		code = codes.ResourceExhausted
+	case ResponseDenied:
+		code = codes.PermissionDenied
+		if s.identity.Name == "" {
+			code = codes.Unauthenticated
+		}
+	case responseInvalid:
+		code, response = codes.InvalidArgument, ResponseError
+	}
+	return status.Error(code, response)
+}
+
+// GRPCClient calls the gRPC API of an indexer, see GRPCServer, with Go types
+// in place of the generated ones. Tokens go in the metadata of ctx, e.g. with
+//
+//	metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+//
+// Errors are gRPC statuses, see grpcError.
+type GRPCClient struct {
+	client indexerpb.PackageIndexerClient
+}
+
+// NewGRPCClient returns a client making calls over conn
+func NewGRPCClient(conn grpc.ClientConnInterface) *GRPCClient {
+	return &GRPCClient{client: indexerpb.NewPackageIndexerClient(conn)}
+}
+
+// Index indexes the package called name
+func (c *GRPCClient) Index(ctx context.Context, name string, dependencies []string) error {
+	_, err := c.client.Index(ctx, &indexerpb.IndexRequest{Name: name, Dependencies: dependencies})
+	return err
+}
+
+// Query returns the package called name, and false if it isn't indexed
+func (c *GRPCClient) Query(ctx context.Context, name string) (*Package, bool, error) {
+	resp, err := c.client.Query(ctx, &indexerpb.QueryRequest{Name: name})
+	if err != nil {
+		return nil, false, err
+	}
+	if !resp.GetFound() || resp.GetPackage() == nil {
+		return nil, false, nil
+	}
+	return newPackageFromPB(resp.GetPackage()), true, nil
+}
+
+// Remove removes the package called name
+func (c *GRPCClient) Remove(ctx context.Context, name string) error {
+	_, err := c.client.Remove(ctx, &indexerpb.RemoveRequest{Name: name})
+	return err
+}
+
+// List returns every package in the server's store, sorted by name
+func (c *GRPCClient) List(ctx context.Context) ([]*Package, error) {
+	stream, err := c.client.List(ctx, &indexerpb.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []*Package
+	for {
+		pkg, err := stream.Recv()
+		if err == io.EOF {
+			return pkgs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, newPackageFromPB(pkg))
+	}
+}
+
+// Watch calls fn with every change to the server's store after sequence number
+// since, or from now on with 0, until ctx is cancelled or fn returns an error.
+// After a RESET event, or an event of another journal, the client has to start
+// over with List.
+func (c *GRPCClient) Watch(ctx context.Context, since uint64, fn func(Mutation) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.client.Watch(ctx, &indexerpb.WatchRequest{Since: since})
+	if err != nil {
+		return err
+	}
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err := fn(newMutationFromPB(event)); err != nil {
+			return err
+		}
+	}
+}
+
+func newPBPackage(pkg *Package) *indexerpb.Package {
+	return &indexerpb.Package{Name: pkg.name, Dependencies: pkg.dependencies, Dependents: pkg.Dependents()}
+}
+
+func newPackageFromPB(pkg *indexerpb.Package) *Package {
+	return NewPackageWithDependents(pkg.GetName(), pkg.GetDependencies(), pkg.GetDependents())
+}
+
+func newPBEvent(m Mutation) *indexerpb.Event {
+	e := &indexerpb.Event{
+		Seq:          m.Seq,
+		Command:      m.Command,
+		Package:      m.Package,
+		Dependencies: m.Dependencies,
+		Journal:      m.Journal,
+	}
+	if !m.Time.IsZero() {
+		e.Time = timestamppb.New(m.Time)
+	}
+	return e
+}
+
+func newMutationFromPB(e *indexerpb.Event) Mutation {
+	m := Mutation{
+		Seq:          e.GetSeq(),
+		Command:      e.GetCommand(),
+		Package:      e.GetPackage(),
+		Dependencies: e.GetDependencies(),
+		Journal:      e.GetJournal(),
+	}
+	if e.GetTime() != nil {
+		m.Time = e.GetTime().AsTime()
+	}
+	return m
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPC serves p over gRPC and returns the server and a client of it
+func startGRPC(t *testing.T, p *PackageIndexer) (*GRPCServer, *GRPCClient) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := p.GRPCServer()
+	go s.Serve(ln)
+	t.Cleanup(func() { s.server.Stop() })
+
+	conn, err := grpc.NewClient("passthrough:///"+ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, NewGRPCClient(conn)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// Testing that the gRPC API answers like the line protocol
+func TestGRPC(t *testing.T) {
+	_, client := startGRPC(t, NewPackageIndexer(10, 4, NewMapStore(), 0))
+	ctx := testContext(t)
+
+	expectCode := func(op string, err error, expected codes.Code) {
+		t.Helper()
+		if status.Code(err) != expected {
+			t.Errorf("%s: expected %s, got %v", op, expected, err)
+		}
+	}
+	expectCode("index b before a", client.Index(ctx, "b", []string{"a"}), codes.FailedPrecondition)
+	expectCode("index a", client.Index(ctx, "a", nil), codes.OK)
+	expectCode("index b", client.Index(ctx, "b", []string{"a"}), codes.OK)
+	expectCode("index a|b", client.Index(ctx, "a|b", nil), codes.InvalidArgument)
+	expectCode("remove a", client.Remove(ctx, "a"), codes.FailedPrecondition)
+
+	pkg, found, err := client.Query(ctx, "a")
+	if err != nil || !found || pkg.Name() != "a" || !reflect.DeepEqual(pkg.Dependents(), []string{"b"}) {
+		t.Errorf("expected a with dependent b, got %v %t %v", pkg, found, err)
+	}
+	if _, found, err := client.Query(ctx, "missing"); err != nil || found {
+		t.Errorf("expected missing not to be found, got %t %v", found, err)
+	}
+
+	pkgs, err := client.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pkg := range pkgs {
+		names = append(names, pkg.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b"}) || !reflect.DeepEqual(pkgs[1].Dependencies(), []string{"a"}) {
+		t.Errorf("expected a and b depending on a, got %v", pkgs)
+	}
+
+	expectCode("remove b", client.Remove(ctx, "b"), codes.OK)
+	expectCode("remove a", client.Remove(ctx, "a"), codes.OK)
+}
+
+// Testing that Watch sends the mutations after a sequence number, and RESET
+// when they are no longer kept
+func TestGRPCWatch(t *testing.T) {
+	s, client := startGRPC(t, NewPackageIndexer(10, 4, NewMapStore(), 0, WithJournal(NewJournal(2))))
+	ctx := testContext(t)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := client.Index(ctx, name, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		since    uint64
+		expected []string
+	}{
+		{3, []string{"4 INDEX d"}},
+		{1, []string{"2 RESET ", "3 INDEX c", "4 INDEX d"}},
+	}
+	errDone := errors.New("done")
+	for _, test := range tests {
+		var events []string
+		err := client.Watch(ctx, test.since, func(m Mutation) error {
+			events = append(events, fmt.Sprintf("%d %s %s", m.Seq, m.Command, m.Package))
+			if len(events) == len(test.expected) {
+				return errDone
+			}
+			return nil
+		})
+		if err != errDone || !reflect.DeepEqual(events, test.expected) {
+			t.Errorf("since %d: expected %v, got %v %v", test.since, test.expected, events, err)
+		}
+	}
+
+	// a watch from now on sees new mutations, until the server shuts down
+	events := make(chan Mutation, 1)
+	watched := make(chan error, 1)
+	go func() {
+		watched <- client.Watch(ctx, 0, func(m Mutation) error {
+			select {
+			case events <- m:
+			default:
+			}
+			return nil
+		})
+	}()
+	for i := 0; ; i++ {
+		// the watch may not have started yet, keep indexing until it sees one
+		if err := client.Index(ctx, fmt.Sprintf("e%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-events:
+			if m.Command != CmdIndex || m.Time.IsZero() || m.Journal == "" {
+				t.Errorf("expected an INDEX event with its journal, got %+v", m)
+			}
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-watched; status.Code(err) != codes.Unavailable {
+		t.Errorf("expected the watch to end with %s, got %v", codes.Unavailable, err)
+	}
+}
+
+// Testing that the gRPC API checks roles like the line protocol
+func TestGRPCAuth(t *testing.T) {
+	credentials, err := writeCredentials(t, "ci writer writer-token", "reporting reader reader-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, client := startGRPC(t, NewPackageIndexer(10, 4, NewMapStore(), 0, WithAuth(credentials, RoleNone)))
+	ctx := testContext(t)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	if _, _, err := client.Query(ctx, "a"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected %s without a token, got %v", codes.Unauthenticated, err)
+	}
+	if _, err := client.List(withToken("wrong-token")); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected %s with a bad token, got %v", codes.Unauthenticated, err)
+	}
+	if err := client.Index(withToken("reader-token"), "a", nil); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected %s for a reader indexing, got %v", codes.PermissionDenied, err)
+	}
+	if err := client.Index(withToken("writer-token"), "a", nil); err != nil {
+		t.Errorf("expected a writer to index, got %v", err)
+	}
+	if pkgs, err := client.List(withToken("reader-token")); err != nil || len(pkgs) != 1 {
+		t.Errorf("expected a reader to list a, got %v %v", pkgs, err)
+	}
+}
+
+// Testing that tokens sent with every call don't count against the rate limit
+// of writes
+func TestGRPCAuthRateLimits(t *testing.T) {
+	credentials, err := writeCredentials(t, "reporting reader reader-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := RateLimits{Reads: Rate{PerSecond: 1000, Burst: 1000}, Writes: Rate{PerSecond: 0.001, Burst: 1}}
+	_, client := startGRPC(t, NewPackageIndexer(10, 4, NewMapStore(), 0, WithAuth(credentials, RoleNone), WithRateLimits(limits)))
+	ctx := metadata.AppendToOutgoingContext(testContext(t), "authorization", "Bearer reader-token")
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := client.Query(ctx, "a"); err != nil {
+			t.Fatalf("query %d: expected no error, got %v", i, err)
+		}
+	}
+}
+
+// Testing that events convert to the generated messages and back
+func TestGRPCEvents(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []Mutation{
+		{Seq: 3, Time: now, Command: CmdIndex, Package: "a", Dependencies: []string{"b", ""}, Journal: "j"},
+		{Seq: 4, Command: CmdReset},
+	}
+	for _, m := range tests {
+		if actual := newMutationFromPB(newPBEvent(m)); !reflect.DeepEqual(actual, m) {
+			t.Errorf("expected %+v, got %+v", m, actual)
+		}
+	}
+	if event := newPBEvent(Mutation{Seq: 1}); event.GetTime() != nil {
+		t.Errorf("expected no time, got %v", event.GetTime())
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import "math/bits"
+
+// hamt is a persistent hash array mapped trie of packages keyed by name. It is
+// never modified in place: put and delete return a new trie that shares every
+// node off the changed path with the old one, so a reader holding an old root
+// keeps seeing the same packages no matter what writers do afterwards.
+//
+// Each level of the trie consumes 5 bits of the name's hash, so a node has at
+// most 32 children, stored compactly and indexed through a bitmap. Names with
+// the same 32 bit hash share a leaf.
+type hamt struct {
+	root *hamtNode
+	size int
+}
+
+const (
+	hamtBits = 5
+	hamtMask = 1<<hamtBits - 1
+)
+
+type hamtNode struct {
+	bitmap uint32
+	// each child is either a *hamtNode or a *hamtLeaf
+	children []interface{}
+}
+
+type hamtLeaf struct {
+	hash uint32
+	pkgs []*Package
+}
+
+func (t hamt) get(name string) (*Package, bool) {
+	h := hashName(name)
+	n := t.root
+	for shift := uint(0); n != nil; shift += hamtBits {
+		bit := uint32(1) << ((h >> shift) & hamtMask)
+		if n.bitmap&bit == 0 {
+			return nil, false
+		}
+		switch c := n.children[n.index(bit)].(type) {
+		case *hamtNode:
+			n = c
+		case *hamtLeaf:
+			if c.hash != h {
+				return nil, false
+			}
+			for _, p := range c.pkgs {
+				if p.name == name {
+					return p, true
+				}
+			}
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func (t hamt) put(p *Package) hamt {
+	root, added := t.root.put(hashName(p.name), 0, p)
+	if added {
+		t.size++
+	}
+	t.root = root
+	return t
+}
+
+func (t hamt) delete(name string) hamt {
+	root, removed := t.root.delete(hashName(name), 0, name)
+	if removed {
+		t.size--
+	}
+	t.root = root
+	return t
+}
+
+// each calls fn for every package in the trie until fn returns false
+func (t hamt) each(fn func(*Package) bool) {
+	t.root.each(fn)
+}
+
+// index returns the position in children of the child for bit
+func (n *hamtNode) index(bit uint32) int {
+	return bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *hamtNode) put(h uint32, shift uint, p *Package) (*hamtNode, bool) {
+	if n == nil {
+		n = &hamtNode{}
+	}
+	bit := uint32(1) << ((h >> shift) & hamtMask)
+	i := n.index(bit)
+
+	if n.bitmap&bit == 0 {
+		children := make([]interface{}, len(n.children)+1)
+		copy(children, n.children[:i])
+		children[i] = &hamtLeaf{hash: h, pkgs: []*Package{p}}
+		copy(children[i+1:], n.children[i:])
+		return &hamtNode{bitmap: n.bitmap | bit, children: children}, true
+	}
+
+	var child interface{}
+	added := false
+	switch c := n.children[i].(type) {
+	case *hamtNode:
+		child, added = c.put(h, shift+hamtBits, p)
+	case *hamtLeaf:
+		if c.hash == h {
+			child, added = c.put(p)
+			break
+		}
+		// push the leaf one level down, two different hashes always differ
+		// somewhere in the remaining bits
+		sub := &hamtNode{
+			bitmap:   uint32(1) << ((c.hash >> (shift + hamtBits)) & hamtMask),
+			children: []interface{}{c},
+		}
+		child, added = sub.put(h, shift+hamtBits, p)
+	}
+	return n.with(i, child), added
+}
+
+func (n *hamtNode) delete(h uint32, shift uint, name string) (*hamtNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+	bit := uint32(1) << ((h >> shift) & hamtMask)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	i := n.index(bit)
+
+	var child interface{}
+	removed := false
+	switch c := n.children[i].(type) {
+	case *hamtNode:
+		sub, ok := c.delete(h, shift+hamtBits, name)
+		if sub != nil {
+			child = sub
+		}
+		removed = ok
+	case *hamtLeaf:
+		if c.hash != h {
+			return n, false
+		}
+		leaf, ok := c.delete(name)
+		if leaf != nil {
+			child = leaf
+		}
+		removed = ok
+	}
+	if !removed {
+		return n, false
+	}
+	if child != nil {
+		return n.with(i, child), true
+	}
+
+	// the child is now empty, drop it
+	if len(n.children) == 1 {
+		return nil, true
+	}
+	children := make([]interface{}, len(n.children)-1)
+	copy(children, n.children[:i])
+	copy(children[i:], n.children[i+1:])
+	return &hamtNode{bitmap: n.bitmap &^ bit, children: children}, true
+}
+
+// with returns a copy of n with the child at i replaced
+func (n *hamtNode) with(i int, child interface{}) *hamtNode {
+	children := make([]interface{}, len(n.children))
+	copy(children, n.children)
+	children[i] = child
+	return &hamtNode{bitmap: n.bitmap, children: children}
+}
+
+func (n *hamtNode) each(fn func(*Package) bool) bool {
+	if n == nil {
+		return true
+	}
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case *hamtNode:
+			if !c.each(fn) {
+				return false
+			}
+		case *hamtLeaf:
+			for _, p := range c.pkgs {
+				if !fn(p) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func (l *hamtLeaf) put(p *Package) (*hamtLeaf, bool) {
+	pkgs := make([]*Package, len(l.pkgs), len(l.pkgs)+1)
+	copy(pkgs, l.pkgs)
+	for i, old := range pkgs {
+		if old.name == p.name {
+			pkgs[i] = p
+			return &hamtLeaf{hash: l.hash, pkgs: pkgs}, false
+		}
+	}
+	return &hamtLeaf{hash: l.hash, pkgs: append(pkgs, p)}, true
+}
+
+// delete returns the leaf without name, or nil if nothing is left in it
+func (l *hamtLeaf) delete(name string) (*hamtLeaf, bool) {
+	for i, p := range l.pkgs {
+		if p.name != name {
+			continue
+		}
+		if len(l.pkgs) == 1 {
+			return nil, true
+		}
+		pkgs := make([]*Package, 0, len(l.pkgs)-1)
+		pkgs = append(pkgs, l.pkgs[:i]...)
+		pkgs = append(pkgs, l.pkgs[i+1:]...)
+		return &hamtLeaf{hash: l.hash, pkgs: pkgs}, true
+	}
+	return l, false
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	packagesPath = "/packages/"
+	// listings of a package, after its name
+	dependenciesPath = "dependencies"
+	dependentsPath   = "dependents"
+)
+
+// PackageJSON is a package as the HTTP API shows it
+type PackageJSON struct {
+	Name         string   `json:"name"`
+	Dependencies []string `json:"dependencies"`
+	Dependents   []string `json:"dependents"`
+}
+
+// StatusJSON is the answer of the HTTP API to anything that doesn't return a
+// package, with the response the line protocol would give
+type StatusJSON struct {
+	Status string `json:"status"`
+}
+
+// HTTPHandler returns a handler serving the index as JSON over HTTP
+//
+//	PUT    /packages/{name}               indexes the package, with a body of {"dependencies": [...]}
+//	GET    /packages/{name}               returns the package, see PackageJSON
+//	DELETE /packages/{name}               removes the package
+//	GET    /packages/{name}/dependencies  returns the names of the packages it depends on
+//	GET    /packages/{name}/dependents    returns the names of the packages depending on it
+//
+// Requests go through the same checks as INDEX, QUERY and REMOVE on the line
+// protocol, authenticated with an "Authorization: Bearer <token>" header, and
+// the response they would get there maps to the status code, see httpStatus.
+func (p *PackageIndexer) HTTPHandler() http.Handler {
+	return &httpHandler{worker: p.newWorker()}
+}
+
+type httpHandler struct {
+	worker *Worker
+}
+
+func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	path := req.URL.EscapedPath()
+	if !strings.HasPrefix(path, packagesPath) {
+		http.NotFound(rw, req)
+		return
+	}
+	segments := strings.Split(strings.TrimPrefix(path, packagesPath), "/")
+	name, err := url.PathUnescape(segments[0])
+	if err != nil || len(segments) > 2 {
+		http.NotFound(rw, req)
+		return
+	}
+	listing := ""
+	if len(segments) == 2 {
+		listing = segments[1]
+		if listing != dependenciesPath && listing != dependentsPath {
+			http.NotFound(rw, req)
+			return
+		}
+	}
+
+	s := h.worker.newSession(req.RemoteAddr)
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); token != "" && h.worker.credentials != nil {
+		if !h.worker.authenticate(s, token) {
+			writeStatus(rw, s, ResponseDenied)
+			return
+		}
+	}
+
+	switch {
+	case req.Method == http.MethodGet:
+		h.get(rw, s, name, listing)
+	case req.Method == http.MethodPut && listing == "":
+		h.put(rw, req, s, name)
+	case req.Method == http.MethodDelete && listing == "":
+		writeStatus(rw, s, h.worker.run(s, CmdRemove, name, nil))
+	default:
+		rw.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// get answers with the package called name, or one of its listings
+func (h *httpHandler) get(rw http.ResponseWriter, s *session, name, listing string) {
+	response := h.worker.run(s, CmdQuery, name, nil)
+	if response == ResponseFail {
+		writeJSON(rw, http.StatusNotFound, StatusJSON{Status: response})
+		return
+	}
+	if response != ResponseOK {
+		writeStatus(rw, s, response)
+		return
+	}
+	// QUERY brought the package into the store if it wasn't, e.g. on mirrors
+	pkg, ok := h.worker.Get(name)
+	if !ok {
+		writeJSON(rw, http.StatusNotFound, StatusJSON{Status: ResponseFail})
+		return
+	}
+
+	dependencies := append([]string{}, pkg.Dependencies()...)
+	switch listing {
+	case dependenciesPath:
+		writeJSON(rw, http.StatusOK, dependencies)
+	case dependentsPath:
+		writeJSON(rw, http.StatusOK, pkg.Dependents())
+	default:
+		writeJSON(rw, http.StatusOK, PackageJSON{Name: name, Dependencies: dependencies, Dependents: pkg.Dependents()})
+	}
+}
+
+// put indexes the package called name with the dependencies in the body
+func (h *httpHandler) put(rw http.ResponseWriter, req *http.Request, s *session, name string) {
+	var body struct {
+		Dependencies []string `json:"dependencies"`
+	}
+	reader := io.Reader(req.Body)
+	if max := h.worker.connLimits.MaxRequestLength; max > 0 {
+		reader = http.MaxBytesReader(rw, req.Body, int64(max))
+	}
+	if err := json.NewDecoder(reader).Decode(&body); err != nil && err != io.EOF {
+		log.Printf("invalid body for %s: %s", name, err.Error())
+		writeJSON(rw, http.StatusBadRequest, StatusJSON{Status: ResponseError})
+		return
+	}
+	writeStatus(rw, s, h.worker.run(s, CmdIndex, name, body.Dependencies))
+}
+
+// httpStatus returns the status code for a response of the line protocol.
+// FAIL is a conflict, with the package's dependencies or dependents, except
+// for reads where it means there is no such package.
+func httpStatus(s *session, response string) int {
+	switch response {
+	case ResponseOK:
+		return http.StatusOK
+	case ResponseFail:
+		return http.StatusConflict
+	case ResponseQuota:
+		return http.StatusRequestEntityTooLarge
+	case ResponseDenied:
+		if s.identity.Name == "" {
+			return http.StatusUnauthorized
+		}
+		return http.StatusForbidden
+	case ResponseThrottled:
+		return http.StatusTooManyRequests
+	case responseInvalid:
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+func writeStatus(rw http.ResponseWriter, s *session, response string) {
+	status := httpStatus(s, response)
+	if status == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if response == responseInvalid {
+		response = ResponseError
+	}
+	writeJSON(rw, status, StatusJSON{Status: response})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("error writing to http client %s", err.Error())
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Testing the HTTP API, and that its status codes follow the line protocol
+func TestHTTP(t *testing.T) {
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0)
+	ts := httptest.NewServer(p.HTTPHandler())
+	defer ts.Close()
+
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"PUT", "/packages/b", `{"dependencies": ["a"]}`, http.StatusConflict, `{"status":"FAIL"}`},
+		{"PUT", "/packages/a", "", http.StatusOK, `{"status":"OK"}`},
+		{"PUT", "/packages/b", `{"dependencies": ["a"]}`, http.StatusOK, `{"status":"OK"}`},
+		{"PUT", "/packages/c%2B%2B", `{"dependencies": ["a", "b"]}`, http.StatusOK, `{"status":"OK"}`},
+		{"GET", "/packages/b", "", http.StatusOK, `{"name":"b","dependencies":["a"],"dependents":["c++"]}`},
+		{"GET", "/packages/a/dependents", "", http.StatusOK, `["b","c++"]`},
+		{"GET", "/packages/c++/dependencies", "", http.StatusOK, `["a","b"]`},
+		{"GET", "/packages/missing", "", http.StatusNotFound, `{"status":"FAIL"}`},
+		{"GET", "/packages/missing/dependents", "", http.StatusNotFound, `{"status":"FAIL"}`},
+		{"DELETE", "/packages/a", "", http.StatusConflict, `{"status":"FAIL"}`},
+		{"DELETE", "/packages/c++", "", http.StatusOK, `{"status":"OK"}`},
+		{"GET", "/packages/b/dependents", "", http.StatusOK, `[]`},
+		{"PUT", "/packages/d", `{"dependencies": ["a|b"]}`, http.StatusBadRequest, `{"status":"ERROR"}`},
+		{"PUT", "/packages/d", `not json`, http.StatusBadRequest, `{"status":"ERROR"}`},
+		{"POST", "/packages/d", "", http.StatusMethodNotAllowed, ""},
+		{"GET", "/packages/a/other", "", http.StatusNotFound, ""},
+		{"GET", "/other", "", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		status, body := httpRequest(t, ts.URL, test.method, test.path, test.body, "")
+		if status != test.status || (test.expected != "" && body != test.expected) {
+			t.Errorf("%s %s: expected %d %s, got %d %s", test.method, test.path, test.status, test.expected, status, body)
+		}
+	}
+}
+
+// Testing that the HTTP API checks roles like the line protocol
+func TestHTTPAuth(t *testing.T) {
+	credentials, err := writeCredentials(t, "ci writer writer-token", "reporting reader reader-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithAuth(credentials, RoleNone))
+	ts := httptest.NewServer(p.HTTPHandler())
+	defer ts.Close()
+
+	tests := []struct {
+		method string
+		token  string
+		status int
+	}{
+		{"GET", "", http.StatusUnauthorized},
+		{"GET", "wrong-token", http.StatusUnauthorized},
+		{"PUT", "reader-token", http.StatusForbidden},
+		{"PUT", "writer-token", http.StatusOK},
+		{"GET", "reader-token", http.StatusOK},
+	}
+	for _, test := range tests {
+		if status, body := httpRequest(t, ts.URL, test.method, "/packages/a", "", test.token); status != test.status {
+			t.Errorf("%s with %q: expected %d, got %d %s", test.method, test.token, test.status, status, body)
+		}
+	}
+}
+
+// Testing that tokens sent with every request don't count against the rate
+// limit of writes
+func TestHTTPAuthRateLimits(t *testing.T) {
+	credentials, err := writeCredentials(t, "reporting reader reader-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := RateLimits{Reads: Rate{PerSecond: 1000, Burst: 1000}, Writes: Rate{PerSecond: 0.001, Burst: 1}}
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithAuth(credentials, RoleNone), WithRateLimits(limits))
+	ts := httptest.NewServer(p.HTTPHandler())
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		if status, body := httpRequest(t, ts.URL, "GET", "/packages/a", "", "reader-token"); status != http.StatusNotFound {
+			t.Fatalf("read %d: expected %d, got %d %s", i, http.StatusNotFound, status, body)
+		}
+	}
+}
+
+// httpRequest sends a request to the API at url and returns the status and
+// the body of the response
+func httpRequest(t *testing.T, url, method, path, body, token string) (int, string) {
+	req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") == "application/json" && !json.Valid(b) {
+		t.Errorf("%s %s: invalid JSON %s", method, path, b)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
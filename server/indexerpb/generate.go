@@ -0,0 +1,6 @@
+// Package indexerpb is the code protoc generates for indexer.proto, the gRPC
+// API of the package indexer. See GRPCServer and GRPCClient in package server
+// for the server and a client built on it.
+package indexerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative indexer.proto
@@ -0,0 +1,293 @@
+// The gRPC API of the package indexer, see GRPCServer in server/grpc.go.
+// Regenerate the Go code with go generate after changing it.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: indexer.proto
+
+package indexerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	PackageIndexer_Index_FullMethodName  = "/packageindexer.PackageIndexer/Index"
+	PackageIndexer_Query_FullMethodName  = "/packageindexer.PackageIndexer/Query"
+	PackageIndexer_Remove_FullMethodName = "/packageindexer.PackageIndexer/Remove"
+	PackageIndexer_List_FullMethodName   = "/packageindexer.PackageIndexer/List"
+	PackageIndexer_Watch_FullMethodName  = "/packageindexer.PackageIndexer/Watch"
+)
+
+// PackageIndexerClient is the client API for PackageIndexer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PackageIndexerClient interface {
+	// INDEX on the line protocol, FAILED_PRECONDITION if dependencies are missing
+	Index(ctx context.Context, in *IndexRequest, opts ...grpc.CallOption) (*IndexResponse, error)
+	// QUERY on the line protocol, with the package if it is indexed
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error)
+	// REMOVE on the line protocol, FAILED_PRECONDITION if dependents are left
+	Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error)
+	// every package in the server's store, sorted by name
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Package], error)
+	// every change to the server's store from now on, or after a sequence number
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type packageIndexerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPackageIndexerClient(cc grpc.ClientConnInterface) PackageIndexerClient {
+	return &packageIndexerClient{cc}
+}
+
+func (c *packageIndexerClient) Index(ctx context.Context, in *IndexRequest, opts ...grpc.CallOption) (*IndexResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(IndexResponse)
+	err := c.cc.Invoke(ctx, PackageIndexer_Index_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *packageIndexerClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QueryResponse)
+	err := c.cc.Invoke(ctx, PackageIndexer_Query_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *packageIndexerClient) Remove(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RemoveResponse)
+	err := c.cc.Invoke(ctx, PackageIndexer_Remove_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *packageIndexerClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Package], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &PackageIndexer_ServiceDesc.Streams[0], PackageIndexer_List_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListRequest, Package]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PackageIndexer_ListClient = grpc.ServerStreamingClient[Package]
+
+func (c *packageIndexerClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &PackageIndexer_ServiceDesc.Streams[1], PackageIndexer_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PackageIndexer_WatchClient = grpc.ServerStreamingClient[Event]
+
+// PackageIndexerServer is the server API for PackageIndexer service.
+// All implementations must embed UnimplementedPackageIndexerServer
+// for forward compatibility.
+type PackageIndexerServer interface {
+	// INDEX on the line protocol, FAILED_PRECONDITION if dependencies are missing
+	Index(context.Context, *IndexRequest) (*IndexResponse, error)
+	// QUERY on the line protocol, with the package if it is indexed
+	Query(context.Context, *QueryRequest) (*QueryResponse, error)
+	// REMOVE on the line protocol, FAILED_PRECONDITION if dependents are left
+	Remove(context.Context, *RemoveRequest) (*RemoveResponse, error)
+	// every package in the server's store, sorted by name
+	List(*ListRequest, grpc.ServerStreamingServer[Package]) error
+	// every change to the server's store from now on, or after a sequence number
+	Watch(*WatchRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedPackageIndexerServer()
+}
+
+// UnimplementedPackageIndexerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPackageIndexerServer struct{}
+
+func (UnimplementedPackageIndexerServer) Index(context.Context, *IndexRequest) (*IndexResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Index not implemented")
+}
+func (UnimplementedPackageIndexerServer) Query(context.Context, *QueryRequest) (*QueryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedPackageIndexerServer) Remove(context.Context, *RemoveRequest) (*RemoveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Remove not implemented")
+}
+func (UnimplementedPackageIndexerServer) List(*ListRequest, grpc.ServerStreamingServer[Package]) error {
+	return status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedPackageIndexerServer) Watch(*WatchRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedPackageIndexerServer) mustEmbedUnimplementedPackageIndexerServer() {}
+func (UnimplementedPackageIndexerServer) testEmbeddedByValue()                        {}
+
+// UnsafePackageIndexerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PackageIndexerServer will
+// result in compilation errors.
+type UnsafePackageIndexerServer interface {
+	mustEmbedUnimplementedPackageIndexerServer()
+}
+
+func RegisterPackageIndexerServer(s grpc.ServiceRegistrar, srv PackageIndexerServer) {
+	// If the following call pancis, it indicates UnimplementedPackageIndexerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&PackageIndexer_ServiceDesc, srv)
+}
+
+func _PackageIndexer_Index_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IndexRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PackageIndexerServer).Index(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PackageIndexer_Index_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PackageIndexerServer).Index(ctx, req.(*IndexRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PackageIndexer_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PackageIndexerServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PackageIndexer_Query_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PackageIndexerServer).Query(ctx, req.(*QueryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PackageIndexer_Remove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PackageIndexerServer).Remove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PackageIndexer_Remove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PackageIndexerServer).Remove(ctx, req.(*RemoveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PackageIndexer_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PackageIndexerServer).List(m, &grpc.GenericServerStream[ListRequest, Package]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PackageIndexer_ListServer = grpc.ServerStreamingServer[Package]
+
+func _PackageIndexer_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PackageIndexerServer).Watch(m, &grpc.GenericServerStream[WatchRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PackageIndexer_WatchServer = grpc.ServerStreamingServer[Event]
+
+// PackageIndexer_ServiceDesc is the grpc.ServiceDesc for PackageIndexer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PackageIndexer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "packageindexer.PackageIndexer",
+	HandlerType: (*PackageIndexerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Index",
+			Handler:    _PackageIndexer_Index_Handler,
+		},
+		{
+			MethodName: "Query",
+			Handler:    _PackageIndexer_Query_Handler,
+		},
+		{
+			MethodName: "Remove",
+			Handler:    _PackageIndexer_Remove_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "List",
+			Handler:       _PackageIndexer_List_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _PackageIndexer_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "indexer.proto",
+}
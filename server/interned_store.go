@@ -0,0 +1,207 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// internedStore is an implementation of PackageStore built for very large
+// indexes. Every package name is interned once and given an integer id, and
+// the graph is kept as slices of ids instead of a map and a slice of strings
+// per package, which takes a fraction of the memory of mapStore. Packages are
+// built on the fly by Get, so reads allocate.
+//
+// Ids are never reused: the name of a removed package stays interned so that
+// it can be indexed again cheaply.
+type internedStore struct {
+	l sync.RWMutex
+
+	ids   map[string]uint32
+	names []string
+	// present[id] is set if the package with that id is in the store
+	present bitset
+	// forward and reverse edges of every package, dependents is kept sorted
+	dependencies [][]uint32
+	dependents   [][]uint32
+	size         int
+	// write transactions committed, see GenerationStore
+	generation uint64
+}
+
+func NewInternedStore() *internedStore {
+	return &internedStore{ids: make(map[string]uint32)}
+}
+
+func (s *internedStore) View(fn func(tx ReadTx) error) error {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return fn(&internedTx{s: s})
+}
+
+func (s *internedStore) Update(fn func(tx WriteTx) error) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	tx := &internedTx{s: s, undo: make(map[string]*Package)}
+	committed := false
+	// roll back on error as well as on panic
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	atomic.AddUint64(&s.generation, 1)
+	return nil
+}
+
+func (s *internedStore) Generation() uint64 {
+	return atomic.LoadUint64(&s.generation)
+}
+
+// intern returns the id of name, giving it one if it doesn't have one yet
+func (s *internedStore) intern(name string) uint32 {
+	if id, ok := s.ids[name]; ok {
+		return id
+	}
+	id := uint32(len(s.names))
+	s.ids[name] = id
+	s.names = append(s.names, name)
+	s.dependencies = append(s.dependencies, nil)
+	s.dependents = append(s.dependents, nil)
+	s.present.grow(len(s.names))
+	return id
+}
+
+func (s *internedStore) get(name string) (*Package, bool) {
+	id, ok := s.ids[name]
+	if !ok || !s.present.get(id) {
+		return nil, false
+	}
+
+	deps := make([]string, len(s.dependencies[id]))
+	for i, d := range s.dependencies[id] {
+		deps[i] = s.names[d]
+	}
+	dependents := make(map[string]interface{}, len(s.dependents[id]))
+	for _, d := range s.dependents[id] {
+		dependents[s.names[d]] = struct{}{}
+	}
+	return &Package{name: name, dependencies: deps, dependents: dependents}, true
+}
+
+func (s *internedStore) put(p *Package) {
+	id := s.intern(p.name)
+
+	deps := make([]uint32, len(p.dependencies))
+	for i, d := range p.dependencies {
+		deps[i] = s.intern(d)
+	}
+	dependents := make([]uint32, 0, len(p.dependents))
+	for d := range p.dependents {
+		dependents = append(dependents, s.intern(d))
+	}
+	sort.Slice(dependents, func(i, j int) bool { return dependents[i] < dependents[j] })
+
+	if !s.present.get(id) {
+		s.present.set(id)
+		s.size++
+	}
+	s.dependencies[id] = deps
+	s.dependents[id] = dependents
+}
+
+func (s *internedStore) delete(name string) {
+	id, ok := s.ids[name]
+	if !ok || !s.present.get(id) {
+		return
+	}
+	s.present.clear(id)
+	s.dependencies[id] = nil
+	s.dependents[id] = nil
+	s.size--
+}
+
+// internedTx is a transaction on an internedStore. Writes go straight to the
+// store, and the previous value of every package is kept so that they can be
+// undone.
+type internedTx struct {
+	s *internedStore
+	// the value each package had before the transaction, nil if it was absent
+	undo map[string]*Package
+}
+
+func (tx *internedTx) Get(p string) (*Package, bool) {
+	return tx.s.get(p)
+}
+
+func (tx *internedTx) Size() int {
+	return tx.s.size
+}
+
+func (tx *internedTx) ForEach(fn func(*Package) bool) {
+	for id, name := range tx.s.names {
+		if !tx.s.present.get(uint32(id)) {
+			continue
+		}
+		pkg, _ := tx.s.get(name)
+		if !fn(pkg) {
+			return
+		}
+	}
+}
+
+func (tx *internedTx) Put(p *Package) {
+	tx.save(p.name)
+	tx.s.put(p)
+}
+
+func (tx *internedTx) Delete(p string) {
+	tx.save(p)
+	tx.s.delete(p)
+}
+
+// save remembers the value of p before it is first changed
+func (tx *internedTx) save(p string) {
+	if _, ok := tx.undo[p]; ok {
+		return
+	}
+	pkg, _ := tx.s.get(p)
+	tx.undo[p] = pkg
+}
+
+func (tx *internedTx) rollback() {
+	for name, pkg := range tx.undo {
+		if pkg == nil {
+			tx.s.delete(name)
+			continue
+		}
+		tx.s.put(pkg)
+	}
+}
+
+// bitset is a growable set of ids
+type bitset []uint64
+
+func (b *bitset) grow(n int) {
+	for len(*b)*64 < n {
+		*b = append(*b, 0)
+	}
+}
+
+func (b bitset) get(i uint32) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b bitset) set(i uint32) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) clear(i uint32) {
+	b[i/64] &^= 1 << (i % 64)
+}
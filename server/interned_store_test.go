@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+var (
+	memReport         = flag.Bool("memreport", false, "run the store memory report")
+	memReportPackages = flag.Int("memreport.packages", 5000000, "number of packages in the memory report graph")
+)
+
+// Testing that packages come back out of the interned store as they went in
+func TestInternedStore(t *testing.T) {
+	s := NewInternedStore()
+	p := &Worker{store: s}
+
+	p.Add(&Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})})
+	p.Add(&Package{name: "b", dependencies: []string{}, dependents: make(map[string]interface{})})
+	p.Add(&Package{name: "c", dependencies: []string{"b", "a"}, dependents: make(map[string]interface{})})
+
+	c, ok := p.Get("c")
+	if !ok {
+		t.Fatal("expected to find c")
+	}
+	expected := &Package{name: "c", dependencies: []string{"b", "a"}, dependents: map[string]interface{}{}}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %v, got %v", expected, c)
+	}
+	a, _ := p.Get("a")
+	if !reflect.DeepEqual(a.dependents, map[string]interface{}{"c": struct{}{}}) {
+		t.Errorf("expected c to be a dependent of a, got %v", a.dependents)
+	}
+
+	if p.Remove("a") {
+		t.Error("expected removing a to fail, c depends on it")
+	}
+	if !p.Remove("c") || !p.Remove("a") {
+		t.Error("expected c and a to be removed")
+	}
+	if p.Query("a") || !p.Query("b") {
+		t.Error("unexpected query result")
+	}
+
+	// a removed package can be indexed again under the same id
+	p.Add(&Package{name: "a", dependencies: []string{"b"}, dependents: make(map[string]interface{})})
+	if !p.Query("a") || s.size != 2 || len(s.names) != 3 {
+		t.Errorf("expected a back in the store, got size %d with %d names", s.size, len(s.names))
+	}
+}
+
+// Testing that a failed update leaves the interned store untouched
+func TestInternedStoreRollback(t *testing.T) {
+	s := NewInternedStore()
+	p := &Worker{store: s}
+	p.Add(&Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})})
+
+	err := s.Update(func(tx WriteTx) error {
+		tx.Put(&Package{name: "b", dependencies: []string{"a"}, dependents: make(map[string]interface{})})
+		if err := addDependents(tx, []string{"a"}, "b"); err != nil {
+			return err
+		}
+		tx.Delete("a")
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("expected update to return an error")
+	}
+
+	a, ok := p.Get("a")
+	if !ok || len(a.dependents) != 0 {
+		t.Errorf("expected a with no dependents, got %v", a)
+	}
+	if p.Query("b") || s.size != 1 {
+		t.Error("expected b to be rolled back")
+	}
+}
+
+// TestMemoryReport compares the heap used by each store once loaded with the
+// same synthetic graph. It only runs when asked to, with
+//
+//	go test ./server -run MemoryReport -args -memreport -memreport.packages 5000000
+func TestMemoryReport(t *testing.T) {
+	if !*memReport {
+		t.Skip("run with -memreport")
+	}
+	n := *memReportPackages
+
+	for _, kind := range []string{StoreMap, StoreInterned} {
+		before := heapInUse()
+		store, _ := NewStore(kind)
+		loadSyntheticGraph(store, n, 5, 1)
+		after := heapInUse()
+
+		t.Logf("%-8s %d packages: %d MB, %d bytes per package",
+			kind, n, (after-before)>>20, (after-before)/uint64(n))
+		runtime.KeepAlive(store)
+	}
+}
+
+// loadSyntheticGraph indexes n packages where each package depends on up to
+// maxDeps of the packages before it. The graph is generated on the fly so that
+// nothing but the store holds on to it.
+func loadSyntheticGraph(store PackageStore, n, maxDeps int, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	p := &Worker{store: store}
+	for i := 0; i < n; i++ {
+		deps := make([]string, 0)
+		if i > 0 {
+			for j := r.Intn(maxDeps + 1); j > 0; j-- {
+				deps = append(deps, fmt.Sprintf("pkg-%d", r.Intn(i)))
+			}
+		}
+		p.Add(&Package{name: fmt.Sprintf("pkg-%d", i), dependencies: deps, dependents: make(map[string]interface{})})
+	}
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
+
+func BenchmarkInternedStore(b *testing.B) {
+	benchmarkStore(b, NewInternedStore())
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// CmdReset is journaled when the whole store is replaced or repaired. It can't
+// be replayed, whoever reads it has to start over from a snapshot.
+const CmdReset = "RESET"
+
+// Mutation is a successful change to the store, as recorded in a Journal
+type Mutation struct {
+	Seq uint64 `json:"seq"`
+	// when the mutation was journaled
+	Time         time.Time `json:"time"`
+	Command      string    `json:"command"`
+	Package      string    `json:"package,omitempty"`
+	Dependencies []string  `json:"dependencies,omitempty"`
+	// ID of the journal, set on the events handed to sinks. Sequence numbers
+	// start over with every journal, that is every time the server starts.
+	Journal string `json:"journal,omitempty"`
+}
+
+// Journal numbers every successful INDEX and REMOVE with a sequence number
+// that increases by one with every mutation, and keeps the most recent ones
+// in memory so that they can be replayed. Mutations a Feed hasn't delivered
+// yet are kept as well, however many there are.
+//
+// Mutations are appended from inside the store transaction that makes them,
+// as its last step, so the order of the journal is the order the changes were
+// committed in.
+type Journal struct {
+	// identifies this history, sequence numbers from different journals can't
+	// be compared
+	id string
+	// how many of the most recent mutations are kept
+	capacity int
+
+	l sync.Mutex
+	// the mutations kept, oldest first, the one with sequence number s is at
+	// s - first
+	buf []Mutation
+	// sequence number of the last mutation, and of the oldest one still in buf
+	last  uint64
+	first uint64
+	// sequence number of the last mutation delivered by each feed
+	feeds map[*Feed]uint64
+	// closed and replaced on every append
+	changed chan struct{}
+}
+
+// NewJournal returns an empty journal keeping the last capacity mutations
+func NewJournal(capacity int) *Journal {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Journal{
+		id:       uuid.New(),
+		capacity: capacity,
+		buf:      make([]Mutation, 0, capacity),
+		first:    1,
+		feeds:    make(map[*Feed]uint64),
+		changed:  make(chan struct{}),
+	}
+}
+
+func (j *Journal) ID() string {
+	return j.id
+}
+
+// Last returns the sequence number of the last mutation, 0 if there are none
+func (j *Journal) Last() uint64 {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.last
+}
+
+// append gives m the next sequence number and the current time, and records it
+func (j *Journal) append(m Mutation) Mutation {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	j.last++
+	m.Seq = j.last
+	m.Time = time.Now().UTC()
+	j.buf = append(j.buf, m)
+	j.evict()
+
+	close(j.changed)
+	j.changed = make(chan struct{})
+	return m
+}
+
+// evict drops the oldest mutations past the capacity that every feed has
+// delivered
+func (j *Journal) evict() {
+	n := len(j.buf) - j.capacity
+	for _, delivered := range j.feeds {
+		if pending := int(delivered + 1 - j.first); pending < n {
+			n = pending
+		}
+	}
+	if n <= 0 {
+		return
+	}
+	for i := range j.buf[:n] {
+		j.buf[i] = Mutation{}
+	}
+	j.buf = j.buf[n:]
+	j.first += uint64(n)
+}
+
+// hold keeps every mutation after the last one from now on, until f delivers
+// it, and returns the sequence number of the last one
+func (j *Journal) hold(f *Feed) uint64 {
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.feeds[f] = j.last
+	return j.last
+}
+
+// delivered lets go of the mutations up to seq held for f
+func (j *Journal) delivered(f *Feed, seq uint64) {
+	j.l.Lock()
+	defer j.l.Unlock()
+	j.feeds[f] = seq
+	j.evict()
+}
+
+// First returns the sequence number of the oldest mutation still kept
+func (j *Journal) First() uint64 {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.first
+}
+
+// since returns up to max mutations starting at sequence number next, and false
+// if some of them are no longer kept
+func (j *Journal) since(next uint64, max int) ([]Mutation, bool) {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	if next < j.first || next > j.last+1 {
+		return nil, false
+	}
+	mutations := make([]Mutation, 0)
+	for s := next; s <= j.last && len(mutations) < max; s++ {
+		mutations = append(mutations, j.buf[s-j.first])
+	}
+	return mutations, true
+}
+
+// wait returns a channel that is closed once the next mutation is appended
+func (j *Journal) wait() <-chan struct{} {
+	j.l.Lock()
+	defer j.l.Unlock()
+	return j.changed
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrInvalidRequest is returned for requests that don't follow the protocol
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrMissingDependency is returned when indexing a package before its dependencies
+	ErrMissingDependency = errors.New("missing dependency")
+	// ErrQuotaExceeded is returned, wrapped with the limit that was hit, when
+	// a request goes over one of the configured Limits
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Limits bounds how much clients can index. A limit of 0 means no limit.
+type Limits struct {
+	// total number of packages in the store
+	MaxPackages int
+	// number of dependencies of a single package
+	MaxDependencies int
+	// length in bytes of a package name
+	MaxNameLength int
+}
+
+// checkPackage returns an error if indexing a package with this name and these
+// dependencies would go over the limits, leaving out the total package count
+func (l Limits) checkPackage(name string, dependencies []string) error {
+	if l.MaxDependencies > 0 && len(dependencies) > l.MaxDependencies {
+		return fmt.Errorf("%w: %d dependencies, the limit is %d", ErrQuotaExceeded, len(dependencies), l.MaxDependencies)
+	}
+	if l.MaxNameLength == 0 {
+		return nil
+	}
+	if len(name) > l.MaxNameLength {
+		return fmt.Errorf("%w: name of %d bytes, the limit is %d", ErrQuotaExceeded, len(name), l.MaxNameLength)
+	}
+	for _, dep := range dependencies {
+		if len(dep) > l.MaxNameLength {
+			return fmt.Errorf("%w: dependency name of %d bytes, the limit is %d", ErrQuotaExceeded, len(dep), l.MaxNameLength)
+		}
+	}
+	return nil
+}
+
+// sizeReserver is implemented by transactions that don't see what concurrent
+// transactions add, so that the packages they add count towards MaxPackages
+// before they are committed
+type sizeReserver interface {
+	reserveSize(max int) (int, bool)
+}
+
+// checkSize returns an error if adding a package in tx would go over the
+// limits. If tx is a sizeReserver, room for the package is reserved, so that
+// concurrent requests can't overshoot the limit.
+func (l Limits) checkSize(tx ReadTx) error {
+	if l.MaxPackages <= 0 {
+		return nil
+	}
+	size := 0
+	if r, ok := tx.(sizeReserver); ok {
+		var reserved bool
+		if size, reserved = r.reserveSize(l.MaxPackages); reserved {
+			return nil
+		}
+	} else if size = tx.Size(); size < l.MaxPackages {
+		return nil
+	}
+	return fmt.Errorf("%w: %d packages, the limit is %d", ErrQuotaExceeded, size, l.MaxPackages)
+}
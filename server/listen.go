@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// UnixPrefix starts the addresses of Unix domain sockets, see Listen
+const UnixPrefix = "unix:"
+
+// DefaultSocketMode lets the owner and group of the indexer's sockets use them
+const DefaultSocketMode os.FileMode = 0660
+
+// Listen listens on addr, which is either host:port for TCP, with IPv6 hosts
+// in brackets, e.g. [::1]:8080, or unix: followed by the path of a Unix domain
+// socket, e.g. unix:/run/package-indexer.sock.
+//
+// A socket is created in a directory only the server can get into, and moved
+// into place once it has been given mode, so it is never open to anyone mode
+// keeps out. A socket left behind by a server that didn't shut down cleanly is
+// replaced, one that a server still listens on is an error. The socket is
+// removed when the listener is closed.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, UnixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, UnixPrefix)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	created := filepath.Join(dir, "socket")
+	ln, err := net.Listen("unix", created)
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed from where it ends up instead
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(created, mode); err == nil {
+		err = os.Rename(created, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: ln, path: path}, nil
+}
+
+// unixListener listens on the socket at path, and removes it once closed
+type unixListener struct {
+	net.Listener
+	path   string
+	remove sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.remove.Do(func() {
+		if rerr := os.Remove(l.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+	})
+	return err
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendTo sends request to the indexer listening on addr and returns the
+// response
+func sendTo(t *testing.T, network, addr, request string) string {
+	conn, err := net.DialTimeout(network, addr, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintln(conn, request)
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading response to %s: %s", request, err.Error())
+	}
+	return strings.TrimSpace(response)
+}
+
+// Testing that every listener serves the same index
+func TestListeners(t *testing.T) {
+	socket := filepath.Join(tempDir(t), "indexer.sock")
+	addrs := []string{"127.0.0.1:0", UnixPrefix + socket}
+	if ln, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		ln.Close()
+		addrs = append(addrs, "[::1]:0")
+	}
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithListenAddrs(addrs...), WithSocketMode(0600))
+	stopped := make(chan error, 1)
+	go func() { stopped <- p.ListenAndServe() }()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(p.Addrs()) < len(addrs) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d listeners, got %v", len(addrs), p.Addrs())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a socket with mode 0600, got %s", info.Mode())
+	}
+
+	for i, addr := range p.Addrs() {
+		name := fmt.Sprintf("pkg-%d", i)
+		if response := sendTo(t, addr.Network(), addr.String(), "INDEX|"+name+"|"); response != ResponseOK {
+			t.Errorf("%s: expected %s, got %s", addr, ResponseOK, response)
+		}
+		for _, other := range p.Addrs() {
+			if response := sendTo(t, other.Network(), other.String(), "QUERY|"+name+"|"); response != ResponseOK {
+				t.Errorf("expected %s indexed on %s to be found on %s, got %s", name, addr, other, response)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-stopped; err != ErrServerClosed {
+		t.Errorf("expected %v, got %v", ErrServerClosed, err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+// Testing that sockets left behind are replaced, and sockets in use aren't,
+// and that a socket is created with its mode
+func TestListenUnix(t *testing.T) {
+	socket := filepath.Join(tempDir(t), "indexer.sock")
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crashed server leaves its socket behind
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := Listen(UnixPrefix+socket, DefaultSocketMode)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	defer ln.Close()
+	// the directory the socket was created in is gone
+	if entries, _ := ioutil.ReadDir(filepath.Dir(socket)); len(entries) != 1 || entries[0].Mode().Perm() != DefaultSocketMode {
+		t.Errorf("expected nothing but the socket with mode %s, got %v", DefaultSocketMode, entries)
+	}
+	if _, err := Listen(UnixPrefix+socket, DefaultSocketMode); err == nil {
+		t.Error("expected a socket in use to be an error")
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Migrate copies every package in src into dst, in dependency order so that
+// each package is added after its dependencies, and returns how many packages
+// were added. Packages already in dst are skipped, so a migration that was
+// interrupted can be resumed by running it again against the same dst.
+//
+// progress, if not nil, is called after every package with the package added,
+// or nil if it was skipped, the number of packages done so far, skipped ones
+// included, and the total. An error from progress stops the migration.
+func Migrate(src, dst PackageStore, progress func(added *Package, done, total int) error) (int, error) {
+	var order []*Package
+	err := src.View(func(tx ReadTx) error {
+		var err error
+		order, err = dependencyOrder(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	w := &Worker{store: dst}
+	added := 0
+	for i, pkg := range order {
+		var a *Package
+		if _, ok := w.Get(pkg.name); !ok {
+			a = &Package{name: pkg.name, dependencies: pkg.dependencies, dependents: make(map[string]interface{})}
+			if !w.Add(a) {
+				return added, fmt.Errorf("could not add %s to the destination", pkg.name)
+			}
+			added++
+		}
+		if progress != nil {
+			if err := progress(a, i+1, len(order)); err != nil {
+				return added, err
+			}
+		}
+	}
+	return added, nil
+}
+
+// migrationEntry is how a package is written in a migration log
+type migrationEntry struct {
+	Name         string   `json:"name"`
+	Dependencies []string `json:"dependencies"`
+}
+
+// WriteMigrationLog appends pkgs to a migration log, one JSON object per line
+// with the name and dependencies of a package. Saving the progress of a
+// migration this way costs as much as the packages migrated since the last
+// save, however large the destination has grown.
+func WriteMigrationLog(w io.Writer, pkgs []*Package) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, pkg := range pkgs {
+		if err := enc.Encode(migrationEntry{Name: pkg.name, Dependencies: pkg.dependencies}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadMigrationLog adds the packages in a migration log written by
+// WriteMigrationLog to dst, in the order they were written, and returns the
+// length of the log up to its last whole entry. A last entry cut short by an
+// interruption is ignored, and should be cut off before appending to the log.
+func ReadMigrationLog(r io.Reader, dst PackageStore) (int64, error) {
+	br := bufio.NewReader(r)
+	w := &Worker{store: dst}
+	var size int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		var e migrationEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return size, fmt.Errorf("error reading migration log: %s", err.Error())
+		}
+		if e.Dependencies == nil {
+			e.Dependencies = make([]string, 0)
+		}
+		if _, ok := w.Get(e.Name); !ok {
+			if !w.Add(&Package{name: e.Name, dependencies: e.Dependencies, dependents: make(map[string]interface{})}) {
+				return size, fmt.Errorf("could not add %s from the migration log", e.Name)
+			}
+		}
+		size += int64(len(line))
+	}
+}
+
+// dependencyOrder returns every package in tx sorted so that each package comes
+// after all of its dependencies, ties broken by name
+func dependencyOrder(tx ReadTx) ([]*Package, error) {
+	pkgs := make([]*Package, 0, tx.Size())
+	tx.ForEach(func(pkg *Package) bool {
+		pkgs = append(pkgs, pkg)
+		return true
+	})
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].name < pkgs[j].name })
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(pkgs))
+	order := make([]*Package, 0, len(pkgs))
+
+	// depth first, without recursion so that long dependency chains can't blow
+	// the stack
+	type frame struct {
+		pkg  *Package
+		next int
+	}
+	for _, root := range pkgs {
+		if state[root.name] != 0 {
+			continue
+		}
+		state[root.name] = visiting
+		stack := []frame{{pkg: root}}
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.next == len(top.pkg.dependencies) {
+				state[top.pkg.name] = done
+				order = append(order, top.pkg)
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			dep := top.pkg.dependencies[top.next]
+			top.next++
+
+			switch state[dep] {
+			case done:
+				continue
+			case visiting:
+				return nil, fmt.Errorf("dependency cycle through %s", dep)
+			}
+			d, ok := tx.Get(dep)
+			if !ok {
+				return nil, fmt.Errorf("%s depends on missing package %s", top.pkg.name, dep)
+			}
+			state[dep] = visiting
+			stack = append(stack, frame{pkg: d})
+		}
+	}
+	return order, nil
+}
+
+// VerifyMigration compares the packages in src and dst and returns every
+// difference in package count, dependencies or dependents. It returns nothing
+// if dst is an exact copy of src.
+func VerifyMigration(src, dst PackageStore) ([]string, error) {
+	differences := make([]string, 0)
+	err := src.View(func(stx ReadTx) error {
+		return dst.View(func(dtx ReadTx) error {
+			if stx.Size() != dtx.Size() {
+				differences = append(differences, fmt.Sprintf("source has %d packages, destination has %d", stx.Size(), dtx.Size()))
+			}
+			stx.ForEach(func(s *Package) bool {
+				d, ok := dtx.Get(s.name)
+				if !ok {
+					differences = append(differences, fmt.Sprintf("%s: missing from destination", s.name))
+					return true
+				}
+				if !sameKeys(sliceToMap(s.dependencies), sliceToMap(d.dependencies)) {
+					differences = append(differences, fmt.Sprintf("%s: dependencies %v, destination has %v", s.name, s.dependencies, d.dependencies))
+				}
+				if !sameKeys(s.dependents, d.dependents) {
+					differences = append(differences, fmt.Sprintf("%s: dependents %v, destination has %v", s.name, mapKeys(s.dependents), mapKeys(d.dependents)))
+				}
+				return true
+			})
+			return nil
+		})
+	})
+	sort.Strings(differences)
+	return differences, err
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Testing migrating between every pair of stores
+func TestMigrate(t *testing.T) {
+	kinds := []string{StoreMap, StoreSharded, StoreMVCC, StoreInterned}
+	pkgs := testWorkload(300, 4, 1)
+
+	for _, from := range kinds {
+		for _, to := range kinds {
+			src, _ := NewStore(from)
+			dst, _ := NewStore(to)
+			p := &Worker{store: src}
+			for _, pkg := range pkgs {
+				p.Add(newPackage(pkg))
+			}
+
+			added, err := Migrate(src, dst, nil)
+			if err != nil {
+				t.Fatalf("%s to %s: %s", from, to, err.Error())
+			}
+			if added != len(pkgs) {
+				t.Errorf("%s to %s: expected %d packages added, got %d", from, to, len(pkgs), added)
+			}
+			differences, err := VerifyMigration(src, dst)
+			if err != nil || len(differences) != 0 {
+				t.Errorf("%s to %s: expected no differences, got %v %v", from, to, differences, err)
+			}
+		}
+	}
+}
+
+// Testing that a migration between different stores leaves the source as it
+// was, and that changes to the destination show up as differences
+func TestVerifyMigrationBetweenStores(t *testing.T) {
+	for _, kinds := range [][2]string{{StoreMap, StoreSharded}, {StoreSharded, StoreMVCC}} {
+		from, to := kinds[0], kinds[1]
+		src, _ := NewStore(from)
+		dst, _ := NewStore(to)
+		original := NewMapStore()
+		for _, store := range []PackageStore{src, original} {
+			w := &Worker{store: store}
+			w.Add(NewPackage("a", nil))
+			w.Add(NewPackage("b", []string{"a"}))
+			w.Add(NewPackage("c", []string{"a", "b"}))
+			w.Add(NewPackage("d", []string{"c"}))
+		}
+
+		if _, err := Migrate(src, dst, nil); err != nil {
+			t.Fatalf("%s to %s: %s", from, to, err.Error())
+		}
+		if differences, _ := VerifyMigration(original, src); len(differences) != 0 {
+			t.Errorf("%s to %s: expected the source to be left as it was, got %v", from, to, differences)
+		}
+		if differences, _ := VerifyMigration(src, dst); len(differences) != 0 {
+			t.Errorf("%s to %s: expected no differences, got %v", from, to, differences)
+		}
+
+		(&Worker{store: dst}).Remove("d")
+		differences, err := VerifyMigration(src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{
+			"c: dependents [d], destination has []",
+			"d: missing from destination",
+			"source has 4 packages, destination has 3",
+		}
+		if !reflect.DeepEqual(differences, expected) {
+			t.Errorf("%s to %s: expected %v, got %v", from, to, expected, differences)
+		}
+	}
+}
+
+// Testing that an interrupted migration picks up where it stopped
+func TestMigrateResume(t *testing.T) {
+	src, dst := NewMapStore(), NewShardedStore(4)
+	p := &Worker{store: src}
+	for _, pkg := range testWorkload(100, 4, 2) {
+		p.Add(newPackage(pkg))
+	}
+
+	interrupted := errors.New("interrupted")
+	added, err := Migrate(src, dst, func(_ *Package, done, total int) error {
+		if done == 40 {
+			return interrupted
+		}
+		return nil
+	})
+	if err != interrupted || added != 40 {
+		t.Fatalf("expected to stop after 40 packages, got %d %v", added, err)
+	}
+
+	added, err = Migrate(src, dst, nil)
+	if err != nil || added != 60 {
+		t.Errorf("expected the remaining 60 packages to be added, got %d %v", added, err)
+	}
+	if differences, _ := VerifyMigration(src, dst); len(differences) != 0 {
+		t.Errorf("expected no differences, got %v", differences)
+	}
+}
+
+// Testing that a migration log brings a destination back to where it was, and
+// that an entry cut short is left out
+func TestMigrationLog(t *testing.T) {
+	src := NewMapStore()
+	p := &Worker{store: src}
+	for _, pkg := range testWorkload(100, 4, 3) {
+		p.Add(newPackage(pkg))
+	}
+
+	var log bytes.Buffer
+	var saved []*Package
+	_, err := Migrate(src, NewMapStore(), func(pkg *Package, done, total int) error {
+		saved = append(saved, pkg)
+		if done%30 == 0 {
+			if err := WriteMigrationLog(&log, saved); err != nil {
+				return err
+			}
+			saved = saved[:0]
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole := log.Len()
+	log.WriteString(`{"name":"cut`)
+
+	dst := NewMapStore()
+	size, err := ReadMigrationLog(&log, dst)
+	if err != nil || size != int64(whole) {
+		t.Fatalf("expected %d bytes of whole entries, got %d %v", whole, size, err)
+	}
+	if len(dst.m) != 90 {
+		t.Errorf("expected the 90 packages saved, got %d", len(dst.m))
+	}
+
+	added, err := Migrate(src, dst, nil)
+	if err != nil || added != 10 {
+		t.Errorf("expected the remaining 10 packages to be added, got %d %v", added, err)
+	}
+	if differences, _ := VerifyMigration(src, dst); len(differences) != 0 {
+		t.Errorf("expected no differences, got %v", differences)
+	}
+}
+
+// Testing that differences are reported
+func TestVerifyMigration(t *testing.T) {
+	src := brokenStore()
+	dst := NewMapStore()
+	(&Worker{store: dst}).Add(&Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})})
+	(&Worker{store: dst}).Add(&Package{name: "c", dependencies: []string{"a"}, dependents: make(map[string]interface{})})
+
+	differences, err := VerifyMigration(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"a: dependents [], destination has [c]",
+		"b: missing from destination",
+		"d: missing from destination",
+		"source has 4 packages, destination has 2",
+	}
+	if !reflect.DeepEqual(differences, expected) {
+		t.Errorf("expected %v, got %v", expected, differences)
+	}
+}
+
+// Testing that a source with a missing dependency is refused up front
+func TestMigrateMissingDependency(t *testing.T) {
+	dst := NewMapStore()
+	if _, err := Migrate(brokenStore(), dst, nil); err == nil {
+		t.Error("expected an error")
+	}
+	if len(dst.m) != 0 {
+		t.Errorf("expected nothing to be migrated, got %v", dst.m)
+	}
+}
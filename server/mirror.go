@@ -0,0 +1,203 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ErrUpstream is returned by a mirror that couldn't get an answer from its
+// upstream
+var ErrUpstream = errors.New("upstream unavailable")
+
+// connections to the upstream kept open between requests
+const mirrorConnections = 16
+
+// Mirror answers QUERY from a local store, and on a miss asks an upstream
+// indexer instead, copying the package and every package it depends on into
+// the local store when the upstream has it. INDEX and REMOVE are forwarded to
+// the upstream, and the local store follows when they succeed. The upstream
+// can itself be a mirror.
+//
+// Packages are only ever evicted by a REMOVE through the mirror, so packages
+// removed from the upstream some other way stay in the local store until it is
+// brought up to date, e.g. with store-diff -repair.
+type Mirror struct {
+	upstream string
+	config   ClientConfig
+	worker   *Worker
+	clients  chan *Client
+}
+
+// NewMirror returns a mirror of the indexer listening at upstream caching into
+// store. Connections to the upstream are made with config, so that the mirror
+// can use TLS and authenticate like any other client.
+func NewMirror(upstream string, store PackageStore, config ClientConfig) *Mirror {
+	return &Mirror{
+		upstream: upstream,
+		config:   config,
+		worker:   NewWorker(store),
+		clients:  make(chan *Client, mirrorConnections),
+	}
+}
+
+// Index forwards pkg to the upstream, see Worker.Index
+func (m *Mirror) Index(pkg *Package) error {
+	response, err := m.send(fmt.Sprintf("%s|%s|%s", CmdIndex, pkg.name, strings.Join(pkg.dependencies, ",")))
+	if err != nil {
+		return err
+	}
+	switch response {
+	case ResponseOK:
+		if _, err := m.fetch(pkg.name); err != nil {
+			log.Printf("could not cache %s: %s", pkg.name, err.Error())
+		}
+		return nil
+	case ResponseFail:
+		return ErrMissingDependency
+	case ResponseQuota:
+		return fmt.Errorf("%w: upstream is full", ErrQuotaExceeded)
+	}
+	return fmt.Errorf("%w: INDEX %s answered %s", ErrUpstream, pkg.name, response)
+}
+
+// Query returns true if name is in the local store, or else in the upstream
+func (m *Mirror) Query(name string) (bool, error) {
+	_, found, err := m.Get(name)
+	return found, err
+}
+
+// Get returns the package called name from the local store, copying it from
+// the upstream first if it isn't there
+func (m *Mirror) Get(name string) (*Package, bool, error) {
+	if pkg, ok := m.worker.Get(name); ok {
+		return pkg, true, nil
+	}
+	found, err := m.fetch(name)
+	if errors.Is(err, ErrUpstream) {
+		return nil, false, err
+	}
+	if err != nil {
+		log.Printf("could not cache %s: %s", name, err.Error())
+	}
+	if !found {
+		return nil, false, nil
+	}
+	pkg, ok := m.worker.Get(name)
+	return pkg, ok, nil
+}
+
+// Remove forwards the removal of name to the upstream, see Worker.Remove
+func (m *Mirror) Remove(name string) (bool, error) {
+	response, err := m.send(fmt.Sprintf("%s|%s|", CmdRemove, name))
+	if err != nil {
+		return false, err
+	}
+	switch response {
+	case ResponseOK:
+		if err := m.evict(name); err != nil {
+			log.Printf("could not evict %s: %s", name, err.Error())
+		}
+		return true, nil
+	case ResponseFail:
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: REMOVE %s answered %s", ErrUpstream, name, response)
+}
+
+// fetch copies the package called name from the upstream into the local store,
+// together with every dependency, direct or not, that isn't there yet. It
+// returns false if the upstream doesn't have the package. Errors getting an
+// answer from the upstream are ErrUpstream, others come from the local store
+// once the upstream has answered that it has the package.
+func (m *Mirror) fetch(name string) (bool, error) {
+	response, err := m.send(fetchRequest(name))
+	if err != nil {
+		return false, err
+	}
+	fetched, found, err := parseFetch(name, response)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s", ErrUpstream, err.Error())
+	}
+	if !found {
+		return false, nil
+	}
+
+	pkgs := make(map[string]*Package)
+	for _, pkg := range fetched {
+		if !m.worker.Query(pkg.name) {
+			pkgs[pkg.name] = pkg
+		}
+	}
+	for _, pkg := range dependenciesFirst(pkgs) {
+		if err := m.worker.Index(NewPackage(pkg.name, pkg.dependencies)); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// evict removes name from the local store, along with every package depending
+// on it there. Those can only be left over from before the upstream removed
+// them, or it wouldn't have allowed the removal.
+func (m *Mirror) evict(name string) error {
+	pkgs := make(map[string]*Package)
+	queue := []string{name}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if _, ok := pkgs[next]; ok {
+			continue
+		}
+		pkg, ok := m.worker.Get(next)
+		if !ok {
+			continue
+		}
+		pkgs[next] = pkg
+		queue = append(queue, pkg.Dependents()...)
+	}
+
+	order := dependenciesFirst(pkgs)
+	for i := len(order) - 1; i >= 0; i-- {
+		if !m.worker.Remove(order[i].name) {
+			return fmt.Errorf("could not remove %s", order[i].name)
+		}
+	}
+	return nil
+}
+
+// send sends request to the upstream over one of the pooled connections, or
+// a new one if they are all busy. A pooled connection may have been closed by
+// the upstream since it was last used, so the request is tried again on a new
+// connection if it fails.
+func (m *Mirror) send(request string) (string, error) {
+	for {
+		var c *Client
+		pooled := true
+		select {
+		case c = <-m.clients:
+		default:
+			var err error
+			if c, err = m.config.Dial(m.upstream); err != nil {
+				return "", fmt.Errorf("%w: %s", ErrUpstream, err.Error())
+			}
+			pooled = false
+		}
+
+		response, err := c.Send(request)
+		if err != nil {
+			c.Close()
+			if pooled {
+				continue
+			}
+			return "", fmt.Errorf("%w: %s", ErrUpstream, err.Error())
+		}
+		select {
+		case m.clients <- c:
+		default:
+			c.Close()
+		}
+		return response, nil
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listen serves w on a random port until the test ends, and returns its address
+func listen(t *testing.T, w *Worker) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go w.handleRequest(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// Testing that a mirror reads through to its upstream and caches what it finds
+func TestMirror(t *testing.T) {
+	upstream := NewWorker(NewMapStore())
+	upstream.Index(NewPackage("a", nil))
+	upstream.Index(NewPackage("b", []string{"a"}))
+	upstream.Index(NewPackage("c", []string{"b"}))
+
+	local := NewMapStore()
+	mirror := NewMirror(listen(t, upstream), local, ClientConfig{})
+	send := serveWorker(t, &Worker{store: local, mirror: mirror})
+	cached := NewWorker(local)
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"QUERY|c|", ResponseOK},
+		{"QUERY|missing|", ResponseFail},
+		{"INDEX|d|c", ResponseOK},
+		{"INDEX|e|missing", ResponseFail},
+		{"REMOVE|a|", ResponseFail},
+		{"REMOVE|d|", ResponseOK},
+	}
+	for _, test := range tests {
+		if actual := send(test.request); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, actual)
+		}
+	}
+
+	// c was cached with everything it depends on
+	for _, name := range []string{"a", "b", "c"} {
+		if !cached.Query(name) {
+			t.Errorf("expected %s to be cached", name)
+		}
+	}
+	if problems := fsck(cached); len(problems) != 0 {
+		t.Errorf("expected a consistent cache, got %v", problems)
+	}
+	// d went upstream, and was removed from both
+	if upstream.Query("d") || cached.Query("d") {
+		t.Error("expected d to be removed everywhere")
+	}
+	if upstream.Query("e") {
+		t.Error("expected e not to be indexed")
+	}
+}
+
+// Testing that a mirror evicts packages left over from before the upstream
+// removed them
+func TestMirrorEvict(t *testing.T) {
+	upstream := NewWorker(NewMapStore())
+	upstream.Index(NewPackage("a", nil))
+	upstream.Index(NewPackage("b", []string{"a"}))
+
+	local := NewMapStore()
+	mirror := NewMirror(listen(t, upstream), local, ClientConfig{})
+	if found, err := mirror.Query("b"); err != nil || !found {
+		t.Fatalf("expected b, got %t %v", found, err)
+	}
+
+	// b is removed behind the mirror's back
+	upstream.Remove("b")
+	if removed, err := mirror.Remove("a"); err != nil || !removed {
+		t.Fatalf("expected a to be removed, got %t %v", removed, err)
+	}
+	cached := NewWorker(local)
+	if cached.Query("a") || cached.Query("b") {
+		t.Error("expected a and b to be evicted")
+	}
+}
+
+// Testing that a mirror's pooled connections, closed by an idle upstream, don't
+// answer its next request
+func TestMirrorIdleUpstream(t *testing.T) {
+	upstream := NewWorker(NewMapStore())
+	upstream.connLimits = ConnectionLimits{IdleTimeout: 100 * time.Millisecond}
+	upstream.Index(NewPackage("a", nil))
+	upstream.Index(NewPackage("b", nil))
+
+	mirror := NewMirror(listen(t, upstream), NewMapStore(), ClientConfig{})
+	if found, err := mirror.Query("a"); err != nil || !found {
+		t.Fatalf("expected a, got %t %v", found, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if found, err := mirror.Query("b"); err != nil || !found {
+		t.Errorf("expected b, got %t %v", found, err)
+	}
+}
+
+// Testing a mirror of a mirror, and a mirror whose upstream is down
+func TestMirrorChain(t *testing.T) {
+	upstream := NewWorker(NewMapStore())
+	upstream.Index(NewPackage("a", nil))
+	upstream.Index(NewPackage("b", []string{"a"}))
+
+	regional := NewWorker(NewMapStore())
+	regional.mirror = NewMirror(listen(t, upstream), regional.store, ClientConfig{})
+	local := NewMapStore()
+	mirror := NewMirror(listen(t, regional), local, ClientConfig{})
+
+	if found, err := mirror.Query("b"); err != nil || !found {
+		t.Fatalf("expected b through the chain, got %t %v", found, err)
+	}
+	if !regional.Query("a") || !NewWorker(local).Query("a") {
+		t.Error("expected a to be cached along the chain")
+	}
+
+	down := NewMirror("127.0.0.1:1", local, ClientConfig{})
+	send := serveWorker(t, &Worker{store: local, mirror: down})
+	if response := send("QUERY|b|"); response != ResponseOK {
+		t.Errorf("expected cached packages to be served, got %s", response)
+	}
+	for _, request := range []string{"QUERY|missing|", "INDEX|c|", "REMOVE|b|"} {
+		if response := send(request); response != ResponseError {
+			t.Errorf("%s: expected %s with the upstream down, got %s", request, ResponseError, response)
+		}
+	}
+}
+
+// Testing that FETCH answers with a package and everything it depends on
+func TestFetch(t *testing.T) {
+	w := NewWorker(NewMapStore())
+	w.Index(NewPackage("a", nil))
+	w.Index(NewPackage("b", []string{"a"}))
+	w.Index(NewPackage("c", []string{"b", "a"}))
+	send := serveWorker(t, w)
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"FETCH|c|", "OK c:b,a: b:a:c a::b,c"},
+		{"FETCH|a|", "OK a::b,c"},
+		{"FETCH|missing|", ResponseFail},
+	}
+	for _, test := range tests {
+		if response := send(test.request); response != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, response)
+		}
+	}
+}
+
+// Testing that a mirror connects to its upstream over TLS and authenticates
+func TestMirrorTLSAuth(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCA(t)
+	files := map[string][]byte{"ca.pem": ca.pem}
+	files["server.pem"], files["server-key.pem"] = ca.issue(t, x509.ExtKeyUsageServerAuth)
+	files["client.pem"], files["client-key.pem"] = ca.issue(t, x509.ExtKeyUsageClientAuth)
+	for name, data := range files {
+		writeFile(t, filepath.Join(dir, name), data, time.Now())
+	}
+	serverTLS, err := NewTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS, err := NewClientTLSConfig(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := writeCredentials(t, "mirror reader mirror-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMapStore()
+	NewWorker(store).Index(NewPackage("a", nil))
+	NewWorker(store).Index(NewPackage("b", []string{"a"}))
+	addr, _ := startIndexer(t, NewPackageIndexer(10, 4, store, 0, WithTLS(serverTLS), WithAuth(credentials, RoleNone)))
+
+	local := NewMapStore()
+	mirror := NewMirror(addr, local, ClientConfig{TLS: clientTLS, Token: "mirror-token"})
+	if found, err := mirror.Query("b"); err != nil || !found {
+		t.Fatalf("expected b from the upstream, got %t %v", found, err)
+	}
+	if !NewWorker(local).Query("a") {
+		t.Error("expected a to be cached with b")
+	}
+
+	for _, config := range []ClientConfig{{TLS: clientTLS, Token: "wrong-token"}, {TLS: clientTLS}, {Token: "mirror-token"}} {
+		if _, err := NewMirror(addr, NewMapStore(), config).Query("b"); !errors.Is(err, ErrUpstream) {
+			t.Errorf("expected %v without TLS and a good token, got %v", ErrUpstream, err)
+		}
+	}
+}
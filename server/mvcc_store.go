@@ -0,0 +1,86 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// mvccStore is an implementation of PackageStore where every committed write
+// publishes a new immutable version of the store. Readers grab the current
+// version with a single atomic load and never take a lock, so a long running
+// View sees a consistent snapshot without holding up INDEX or REMOVE. Writers
+// are serialized with a mutex and build the next version by copying only the
+// path to each package they change, see hamt.
+type mvccStore struct {
+	// serializes writers
+	l       sync.Mutex
+	current atomic.Value // hamt
+	// write transactions committed, see GenerationStore
+	generation uint64
+}
+
+func NewMVCCStore() *mvccStore {
+	s := &mvccStore{}
+	s.current.Store(hamt{})
+	return s
+}
+
+func (s *mvccStore) snapshot() hamt {
+	return s.current.Load().(hamt)
+}
+
+func (s *mvccStore) View(fn func(tx ReadTx) error) error {
+	return fn(&mvccTx{t: s.snapshot()})
+}
+
+func (s *mvccStore) Version(at func()) ReadTx {
+	s.l.Lock()
+	defer s.l.Unlock()
+	at()
+	return &mvccTx{t: s.snapshot()}
+}
+
+func (s *mvccStore) Update(fn func(tx WriteTx) error) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	// nothing is published until fn succeeds, so rolling back is just a
+	// matter of dropping the transaction
+	tx := &mvccTx{t: s.snapshot()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.generation, 1)
+	s.current.Store(tx.t)
+	return nil
+}
+
+func (s *mvccStore) Generation() uint64 {
+	return atomic.LoadUint64(&s.generation)
+}
+
+// mvccTx is a transaction on one version of an mvccStore. Writes build a new
+// version that only the transaction can see until it is published.
+type mvccTx struct {
+	t hamt
+}
+
+func (tx *mvccTx) Get(p string) (*Package, bool) {
+	return tx.t.get(p)
+}
+
+func (tx *mvccTx) Size() int {
+	return tx.t.size
+}
+
+func (tx *mvccTx) ForEach(fn func(*Package) bool) {
+	tx.t.each(fn)
+}
+
+func (tx *mvccTx) Put(p *Package) {
+	tx.t = tx.t.put(p)
+}
+
+func (tx *mvccTx) Delete(p string) {
+	tx.t = tx.t.delete(p)
+}
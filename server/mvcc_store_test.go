@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Testing the persistent trie against a plain map
+func TestHamt(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	expected := make(map[string]*Package)
+	var trie hamt
+
+	for i := 0; i < 20000; i++ {
+		name := fmt.Sprintf("pkg-%d", r.Intn(5000))
+		if r.Intn(3) == 0 {
+			trie = trie.delete(name)
+			delete(expected, name)
+			continue
+		}
+		pkg := &Package{name: name}
+		trie = trie.put(pkg)
+		expected[name] = pkg
+	}
+
+	if trie.size != len(expected) {
+		t.Errorf("expected size %d, got %d", len(expected), trie.size)
+	}
+	for name, pkg := range expected {
+		if got, ok := trie.get(name); !ok || got != pkg {
+			t.Errorf("expected %v for %s, got %v", pkg, name, got)
+		}
+	}
+	count := 0
+	trie.each(func(p *Package) bool {
+		if expected[p.name] != p {
+			t.Errorf("unexpected package %v", p)
+		}
+		count++
+		return true
+	})
+	if count != len(expected) {
+		t.Errorf("expected to iterate over %d packages, got %d", len(expected), count)
+	}
+}
+
+// Testing that old versions of the trie are left untouched by writes
+func TestHamtPersistent(t *testing.T) {
+	var v1 hamt
+	for i := 0; i < 100; i++ {
+		v1 = v1.put(&Package{name: fmt.Sprintf("pkg-%d", i)})
+	}
+	v2 := v1.delete("pkg-1").put(&Package{name: "new"})
+
+	if _, ok := v1.get("pkg-1"); !ok {
+		t.Error("expected pkg-1 in the old version")
+	}
+	if _, ok := v1.get("new"); ok {
+		t.Error("expected new to be missing from the old version")
+	}
+	if _, ok := v2.get("pkg-1"); ok {
+		t.Error("expected pkg-1 to be missing from the new version")
+	}
+	if v1.size != 100 || v2.size != 100 {
+		t.Errorf("expected both versions to have 100 packages, got %d and %d", v1.size, v2.size)
+	}
+}
+
+// Testing that a reader keeps its snapshot and doesn't block writers
+func TestMVCCStoreSnapshot(t *testing.T) {
+	s := NewMVCCStore()
+	p := &Worker{store: s}
+	p.Add(&Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})})
+
+	s.View(func(tx ReadTx) error {
+		done := make(chan bool)
+		go func() {
+			done <- p.Add(&Package{name: "b", dependencies: []string{"a"}, dependents: make(map[string]interface{})})
+		}()
+		select {
+		case ok := <-done:
+			if !ok {
+				t.Error("expected b to be added")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("writer blocked by reader")
+		}
+
+		if _, ok := tx.Get("b"); ok {
+			t.Error("expected the snapshot not to see b")
+		}
+		a, _ := tx.Get("a")
+		if len(a.dependents) != 0 {
+			t.Errorf("expected a to have no dependents in the snapshot, got %v", a.dependents)
+		}
+		return nil
+	})
+
+	if !p.Query("b") {
+		t.Error("expected b after the snapshot is released")
+	}
+}
+
+// Testing that a failed update publishes nothing
+func TestMVCCStoreRollback(t *testing.T) {
+	s := NewMVCCStore()
+	s.Update(func(tx WriteTx) error {
+		tx.Put(&Package{name: "a"})
+		return nil
+	})
+	err := s.Update(func(tx WriteTx) error {
+		tx.Put(&Package{name: "b"})
+		tx.Delete("a")
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("expected update to return an error")
+	}
+
+	s.View(func(tx ReadTx) error {
+		if _, ok := tx.Get("a"); !ok || tx.Size() != 1 {
+			t.Error("expected only a in the store")
+		}
+		return nil
+	})
+}
+
+func BenchmarkMVCCStore(b *testing.B) {
+	benchmarkStore(b, NewMVCCStore())
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often buckets left full, and so no different from new ones, are dropped
+const rateLimitSweepInterval = time.Minute
+
+// Rate is how many requests a client can make, in a token bucket of Burst
+// tokens refilled at PerSecond tokens a second. A PerSecond of 0 means no
+// limit.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateLimits are the rates each client gets, separately for requests that
+// only read the store and for the others. AUTH counts as a write, so that
+// guessing tokens is slow.
+//
+// Clients are told apart by their identity once they authenticated, and by
+// their IP address until then.
+type RateLimits struct {
+	Reads  Rate
+	Writes Rate
+}
+
+// RateLimitStats counts the requests allowed and throttled so far
+type RateLimitStats struct {
+	ReadsAllowed    uint64
+	ReadsThrottled  uint64
+	WritesAllowed   uint64
+	WritesThrottled uint64
+	// buckets kept for clients that made requests lately
+	Buckets int
+}
+
+// RateLimiter keeps a read and a write bucket for every client
+type RateLimiter struct {
+	limits RateLimits
+	now    func() time.Time
+
+	l         sync.Mutex
+	buckets   map[rateKey]*bucket
+	lastSweep time.Time
+
+	readsAllowed    uint64
+	readsThrottled  uint64
+	writesAllowed   uint64
+	writesThrottled uint64
+}
+
+type rateKey struct {
+	client string
+	write  bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter giving every client limits
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:    limits,
+		now:       time.Now,
+		buckets:   make(map[rateKey]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from the client's bucket for the request, and returns
+// false if there is none left
+func (r *RateLimiter) Allow(client string, write bool) bool {
+	rate := r.limits.Reads
+	allowed, throttled := &r.readsAllowed, &r.readsThrottled
+	if write {
+		rate = r.limits.Writes
+		allowed, throttled = &r.writesAllowed, &r.writesThrottled
+	}
+	if rate.PerSecond <= 0 {
+		atomic.AddUint64(allowed, 1)
+		return true
+	}
+
+	r.l.Lock()
+	now := r.now()
+	if now.Sub(r.lastSweep) >= rateLimitSweepInterval {
+		r.sweep(now)
+	}
+	key := rateKey{client: client, write: write}
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst(rate)), last: now}
+		r.buckets[key] = b
+	}
+	ok = b.take(rate, now)
+	r.l.Unlock()
+
+	if !ok {
+		atomic.AddUint64(throttled, 1)
+		return false
+	}
+	atomic.AddUint64(allowed, 1)
+	return true
+}
+
+// Stats returns how many requests were allowed and throttled
+func (r *RateLimiter) Stats() RateLimitStats {
+	r.l.Lock()
+	buckets := len(r.buckets)
+	r.l.Unlock()
+	return RateLimitStats{
+		ReadsAllowed:    atomic.LoadUint64(&r.readsAllowed),
+		ReadsThrottled:  atomic.LoadUint64(&r.readsThrottled),
+		WritesAllowed:   atomic.LoadUint64(&r.writesAllowed),
+		WritesThrottled: atomic.LoadUint64(&r.writesThrottled),
+		Buckets:         buckets,
+	}
+}
+
+// RateLimitStats returns how many requests were allowed and throttled, all
+// zero without rate limits
+func (p *PackageIndexer) RateLimitStats() RateLimitStats {
+	if p.rateLimiter == nil {
+		return RateLimitStats{}
+	}
+	return p.rateLimiter.Stats()
+}
+
+// sweep drops the buckets that have filled up again, the client gets a new
+// full one if it comes back
+func (r *RateLimiter) sweep(now time.Time) {
+	for key, b := range r.buckets {
+		rate := r.limits.Reads
+		if key.write {
+			rate = r.limits.Writes
+		}
+		b.refill(rate, now)
+		if b.tokens >= float64(burst(rate)) {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+// take refills the bucket for the time since it was last used and takes a
+// token from it, if there is one
+func (b *bucket) take(rate Rate, now time.Time) bool {
+	b.refill(rate, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) refill(rate Rate, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * rate.PerSecond
+	if max := float64(burst(rate)); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// burst returns the size of the buckets, at least one request
+func burst(rate Rate) int {
+	if rate.Burst < 1 {
+		return 1
+	}
+	return rate.Burst
+}
+
+// rateLimitClient returns who a request in session s is counted against: the
+// identity if the client authenticated, and otherwise its connection for
+// clients of Unix domain sockets and its IP address for the others
+func rateLimitClient(s *session) string {
+	if s.identity.Name != "" {
+		return "identity " + s.identity.Name
+	}
+	if s.connection != "" {
+		return s.connection
+	}
+	if host, _, err := net.SplitHostPort(s.remoteAddr); err == nil {
+		return "address " + host
+	}
+	return "address " + s.remoteAddr
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Testing that buckets run out, refill over time and are kept apart
+func TestRateLimiter(t *testing.T) {
+	r := NewRateLimiter(RateLimits{
+		Reads:  Rate{PerSecond: 2, Burst: 3},
+		Writes: Rate{PerSecond: 1},
+	})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !r.Allow("a", false) {
+			t.Fatalf("expected read %d to be allowed", i)
+		}
+	}
+	if r.Allow("a", false) {
+		t.Error("expected reads over the burst to be throttled")
+	}
+	if !r.Allow("b", false) {
+		t.Error("expected another client to have its own bucket")
+	}
+	if !r.Allow("a", true) || r.Allow("a", true) {
+		t.Error("expected a single write to be allowed")
+	}
+
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if !r.Allow("a", false) {
+			t.Errorf("expected read %d to be allowed after a second", i)
+		}
+	}
+	if r.Allow("a", false) {
+		t.Error("expected the bucket to refill at the rate")
+	}
+
+	expected := RateLimitStats{ReadsAllowed: 6, ReadsThrottled: 2, WritesAllowed: 1, WritesThrottled: 1, Buckets: 3}
+	if stats := r.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+	// buckets left to fill up are dropped
+	now = now.Add(rateLimitSweepInterval)
+	r.Allow("b", true)
+	if stats := r.Stats(); stats.Buckets != 1 {
+		t.Errorf("expected the full buckets to be dropped, got %d left", stats.Buckets)
+	}
+}
+
+// Testing that clients over their rate are answered with THROTTLED, counted
+// by address until they authenticate
+func TestRateLimitCommands(t *testing.T) {
+	credentials, err := writeCredentials(t, "ci writer writer-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{
+		store:       NewMapStore(),
+		credentials: credentials,
+		anonymous:   RoleReader,
+		rateLimiter: NewRateLimiter(RateLimits{Reads: Rate{PerSecond: 0.001, Burst: 2}, Writes: Rate{PerSecond: 0.001, Burst: 2}}),
+	}
+	first, second := serveWorker(t, w), serveWorker(t, w)
+
+	tests := []struct {
+		send     func(string) string
+		request  string
+		expected string
+	}{
+		{first, "QUERY|a|", ResponseFail},
+		{second, "QUERY|a|", ResponseFail},
+		// both connections come from the same address
+		{first, "QUERY|a|", ResponseThrottled},
+		{first, "AUTH|writer-token|", ResponseOK},
+		{first, "INDEX|a|", ResponseOK},
+		{first, "QUERY|a|", ResponseOK},
+		{first, "INDEX|b|", ResponseOK},
+		{first, "INDEX|c|", ResponseThrottled},
+		{second, "QUERY|a|", ResponseThrottled},
+	}
+	for _, test := range tests {
+		if actual := test.send(test.request); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, actual)
+		}
+	}
+}
+
+// Testing that clients of a Unix domain socket get a bucket per connection
+func TestRateLimitUnixConnections(t *testing.T) {
+	ln, err := Listen(UnixPrefix+filepath.Join(tempDir(t), "indexer.sock"), DefaultSocketMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	w := &Worker{
+		store:       NewMapStore(),
+		anonymous:   RoleReader,
+		rateLimiter: NewRateLimiter(RateLimits{Reads: Rate{PerSecond: 0.001}}),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go w.handleRequest(conn)
+		}
+	}()
+
+	conn, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{ResponseFail, ResponseThrottled} {
+		fmt.Fprintln(conn, "QUERY|a|")
+		if response, _ := reader.ReadString('\n'); strings.TrimSpace(response) != expected {
+			t.Errorf("expected %s, got %q", expected, response)
+		}
+	}
+	if response := sendTo(t, "unix", ln.Addr().String(), "QUERY|a|"); response != ResponseFail {
+		t.Errorf("expected another connection to have its own bucket, got %s", response)
+	}
+}
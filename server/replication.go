@@ -0,0 +1,360 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Replication runs over its own TCP connection, one per follower. The follower
+// opens it with a single line
+//
+//	SYNC <journal id> <next sequence number>
+//
+// and the leader answers with a stream of JSON messages, one per line:
+//
+//	{"type":"mutation","mutation":{"seq":12,"command":"INDEX","package":"a","dependencies":["b"]}}
+//	{"type":"heartbeat","seq":12}
+//	{"type":"snapshot","journal":"<journal id>","seq":12}
+//
+// A snapshot message is followed by a whole snapshot as written by
+// WriteSnapshot, holding every mutation up to and including seq. The leader
+// sends one first whenever the follower can't catch up from the journal alone:
+// it comes from another leader, it is too far behind, or the leader's store
+// was replaced by a RESTORE or FSCK repair since.
+const (
+	msgMutation  = "mutation"
+	msgHeartbeat = "heartbeat"
+	msgSnapshot  = "snapshot"
+
+	// how often an idle leader lets followers know it's still there
+	replicationHeartbeat = time.Second
+	// how long either side waits on the other before giving up on the connection
+	replicationTimeout = 5 * replicationHeartbeat
+	// most mutations sent between two flushes
+	replicationBatch = 1000
+)
+
+type replicationMessage struct {
+	Type     string    `json:"type"`
+	Journal  string    `json:"journal,omitempty"`
+	Seq      uint64    `json:"seq,omitempty"`
+	Mutation *Mutation `json:"mutation,omitempty"`
+}
+
+// ReplicationServer streams the mutations recorded in a journal to followers
+type ReplicationServer struct {
+	journal *Journal
+	store   PackageStore
+}
+
+// NewReplicationServer returns a leader for the given store. Every worker
+// writing to the store must record its mutations in journal, see WithJournal.
+func NewReplicationServer(journal *Journal, store PackageStore) *ReplicationServer {
+	return &ReplicationServer{journal: journal, store: store}
+}
+
+// Serve accepts follower connections on ln until it fails
+func (r *ReplicationServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := r.serveFollower(conn)
+			log.Printf("follower %s disconnected: %v", conn.RemoteAddr(), err)
+			conn.Close()
+		}()
+	}
+}
+
+func (r *ReplicationServer) serveFollower(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var id string
+	var next uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(line), "SYNC %s %d", &id, &next); err != nil {
+		return fmt.Errorf("invalid handshake %q", strings.TrimSpace(line))
+	}
+	log.Printf("follower %s syncing from %d", conn.RemoteAddr(), next)
+
+	w := bufio.NewWriter(progressConn{Conn: conn, timeout: replicationTimeout})
+	enc := json.NewEncoder(w)
+	needSnapshot := id != r.journal.ID()
+
+	for {
+		// get the wait channel before reading, so nothing appended in between is missed
+		changed := r.journal.wait()
+
+		var mutations []Mutation
+		if !needSnapshot {
+			var ok bool
+			mutations, ok = r.journal.since(next, replicationBatch)
+			needSnapshot = !ok
+		}
+
+		if needSnapshot {
+			seq, snapshot, err := r.snapshotFor(w, enc, next-1)
+			if err != nil {
+				return err
+			}
+			log.Printf("sending snapshot at %d to follower %s", seq, conn.RemoteAddr())
+			if err := enc.Encode(replicationMessage{Type: msgSnapshot, Journal: r.journal.ID(), Seq: seq}); err != nil {
+				return err
+			}
+			if _, err := w.Write(snapshot); err != nil {
+				return err
+			}
+			next = seq + 1
+			needSnapshot = false
+			continue
+		}
+
+		for _, m := range mutations {
+			if m.Command == CmdReset {
+				needSnapshot = true
+				break
+			}
+			m := m
+			if err := enc.Encode(replicationMessage{Type: msgMutation, Mutation: &m}); err != nil {
+				return err
+			}
+			next = m.Seq + 1
+		}
+
+		if len(mutations) == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			select {
+			case <-changed:
+			case <-time.After(replicationHeartbeat):
+				if err := enc.Encode(replicationMessage{Type: msgHeartbeat, Seq: next - 1}); err != nil {
+					return err
+				}
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// snapshot returns a snapshot of the store together with the sequence number of
+// the last mutation in it. It is taken from a read transaction, see
+// consistentView, and written to memory first so that slow followers don't hold
+// up writers for longer than it takes to write it out.
+func (r *ReplicationServer) snapshot() (uint64, []byte, error) {
+	var seq uint64
+	var buf bytes.Buffer
+	err := consistentView(r.store, func() { seq = r.journal.Last() }, func(tx ReadTx) error {
+		return WriteSnapshot(&buf, tx)
+	})
+	return seq, buf.Bytes(), err
+}
+
+// snapshotFor takes a snapshot for a follower that has everything up to seq,
+// sending it heartbeats meanwhile so that it doesn't give up on a large store
+func (r *ReplicationServer) snapshotFor(w *bufio.Writer, enc *json.Encoder, seq uint64) (uint64, []byte, error) {
+	type taken struct {
+		seq      uint64
+		snapshot []byte
+		err      error
+	}
+	done := make(chan taken, 1)
+	go func() {
+		seq, snapshot, err := r.snapshot()
+		done <- taken{seq, snapshot, err}
+	}()
+	for {
+		select {
+		case t := <-done:
+			return t.seq, t.snapshot, t.err
+		case <-time.After(replicationHeartbeat):
+			if err := enc.Encode(replicationMessage{Type: msgHeartbeat, Seq: seq}); err != nil {
+				return 0, nil, err
+			}
+			if err := w.Flush(); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+}
+
+// the most written at once by progressConn
+const progressChunk = 64 << 10
+
+// progressConn gives every read, and every chunk of a write, timeout to
+// complete. A transfer of any size goes on as long as the other side keeps up,
+// and fails once it stops for timeout.
+type progressConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c progressConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c progressConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > progressChunk {
+			chunk = chunk[:progressChunk]
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Follower keeps a store identical to the store of a leader, applying the
+// mutations the leader streams in order
+type Follower struct {
+	leader string
+	store  PackageStore
+	worker *Worker
+
+	// the leader's journal, and the sequence number of the last mutation applied
+	journal string
+	applied uint64
+}
+
+// NewFollower returns a follower replicating the leader listening at address
+// into store. Nothing else should write to store.
+func NewFollower(leader string, store PackageStore) *Follower {
+	return &Follower{leader: leader, store: store, worker: NewWorker(store)}
+}
+
+// Applied returns the sequence number of the last mutation applied
+func (f *Follower) Applied() uint64 {
+	return atomic.LoadUint64(&f.applied)
+}
+
+// Run replicates from the leader until ctx is cancelled, reconnecting whenever
+// the connection drops
+func (f *Follower) Run(ctx context.Context) error {
+	backoff := 100 * time.Millisecond
+	for {
+		err := f.sync(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("replication from %s stopped: %v, reconnecting in %s", f.leader, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < replicationTimeout {
+			backoff *= 2
+		}
+	}
+}
+
+// sync replicates over a single connection until it fails
+func (f *Follower) sync(ctx context.Context) error {
+	d := net.Dialer{Timeout: replicationTimeout}
+	conn, err := d.DialContext(ctx, "tcp", f.leader)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	journal := f.journal
+	if journal == "" {
+		journal = "-"
+	}
+	if _, err := fmt.Fprintf(conn, "SYNC %s %d\n", journal, f.Applied()+1); err != nil {
+		return err
+	}
+
+	// snapshots can take longer than replicationTimeout to arrive, the leader
+	// only has to keep sending
+	r := bufio.NewReader(progressConn{Conn: conn, timeout: replicationTimeout})
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var msg replicationMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return fmt.Errorf("invalid message from leader: %s", err.Error())
+		}
+
+		switch msg.Type {
+		case msgSnapshot:
+			restored, err := readConsistentSnapshot(r)
+			if err != nil {
+				return fmt.Errorf("invalid snapshot from leader: %s", err.Error())
+			}
+			err = f.store.Update(func(tx WriteTx) error {
+				replaceAll(tx, restored)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			f.journal = msg.Journal
+			atomic.StoreUint64(&f.applied, msg.Seq)
+			log.Printf("loaded snapshot at %d from %s", msg.Seq, f.leader)
+
+		case msgMutation:
+			m := msg.Mutation
+			if m == nil || m.Seq != f.Applied()+1 {
+				return errors.New("mutation out of order")
+			}
+			if err := f.apply(m); err != nil {
+				// start over from a snapshot next time
+				f.journal = ""
+				return fmt.Errorf("could not apply mutation %d: %s", m.Seq, err.Error())
+			}
+			atomic.StoreUint64(&f.applied, m.Seq)
+		}
+	}
+}
+
+func (f *Follower) apply(m *Mutation) error {
+	switch m.Command {
+	case CmdIndex:
+		deps := m.Dependencies
+		if deps == nil {
+			deps = make([]string, 0)
+		}
+		return f.worker.Index(NewPackage(m.Package, deps))
+	case CmdRemove:
+		if !f.worker.Remove(m.Package) {
+			return errors.New("package still has dependents")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %s", m.Command)
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Testing that the journal keeps the most recent mutations in order
+func TestJournal(t *testing.T) {
+	j := NewJournal(3)
+	if m, ok := j.since(1, 10); !ok || len(m) != 0 {
+		t.Errorf("expected an empty journal, got %v %t", m, ok)
+	}
+
+	changed := j.wait()
+	for i := 1; i <= 5; i++ {
+		j.append(Mutation{Command: CmdIndex, Package: fmt.Sprintf("pkg-%d", i)})
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("expected waiters to be woken up")
+	}
+
+	if j.Last() != 5 {
+		t.Errorf("expected last 5, got %d", j.Last())
+	}
+	if _, ok := j.since(2, 10); ok {
+		t.Error("expected mutation 2 to be gone")
+	}
+	m, ok := j.since(3, 2)
+	if !ok || len(m) != 2 || m[0].Seq != 3 || m[1].Package != "pkg-4" {
+		t.Errorf("expected mutations 3 and 4, got %v", m)
+	}
+	if m, ok := j.since(6, 10); !ok || len(m) != 0 {
+		t.Errorf("expected nothing after 5, got %v %t", m, ok)
+	}
+	if _, ok := j.since(7, 10); ok {
+		t.Error("expected mutations from the future to be refused")
+	}
+}
+
+// leader is a worker recording into a journal, with a replication server
+// listening on a random port
+type leader struct {
+	*Worker
+	journal *Journal
+	addr    string
+}
+
+func startLeader(t *testing.T, capacity int) *leader {
+	return startLeaderStore(t, capacity, NewMapStore())
+}
+
+func startLeaderStore(t *testing.T, capacity int, store PackageStore) *leader {
+	j := NewJournal(capacity)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go NewReplicationServer(j, store).Serve(ln)
+	return &leader{Worker: &Worker{store: store, journal: j}, journal: j, addr: ln.Addr().String()}
+}
+
+// follow runs f until the test ends or the returned function is called
+func follow(t *testing.T, f *Follower) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Run(ctx)
+		close(done)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitForSync waits for the follower to apply everything in the leader's
+// journal, and checks that both stores hold the same packages
+func waitForSync(t *testing.T, l *leader, f *Follower) {
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Applied() != l.journal.Last() {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower stuck at %d, leader at %d", f.Applied(), l.journal.Last())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	differences, err := VerifyMigration(l.store, f.store)
+	if err != nil || len(differences) != 0 {
+		t.Errorf("expected identical stores, got %v %v", differences, err)
+	}
+}
+
+func indexAll(w *Worker, pkgs []*Package) {
+	for _, pkg := range pkgs {
+		w.Add(newPackage(pkg))
+	}
+}
+
+// Testing that a follower applies the leader's mutations and catches up from
+// the journal after disconnecting
+func TestReplication(t *testing.T) {
+	l := startLeader(t, 1000)
+	pkgs := testWorkload(100, 3, 1)
+	indexAll(l.Worker, pkgs[:50])
+
+	f := NewFollower(l.addr, NewMapStore())
+	stop := follow(t, f)
+	waitForSync(t, l, f)
+
+	indexAll(l.Worker, pkgs[50:])
+	l.Remove(pkgs[99].name)
+	waitForSync(t, l, f)
+
+	stop()
+	before := f.Applied()
+	for _, pkg := range pkgs[90:99] {
+		l.Remove(pkg.name)
+	}
+	l.Add(newPackage(pkgs[99]))
+
+	// the follower keeps its store, so it only needs the tail of the journal
+	follow(t, f)
+	waitForSync(t, l, f)
+	if f.Applied() <= before {
+		t.Errorf("expected the follower to move on from %d", before)
+	}
+}
+
+// Testing that a follower that fell too far behind starts over from a snapshot
+func TestReplicationSnapshot(t *testing.T) {
+	l := startLeader(t, 5)
+	pkgs := testWorkload(50, 3, 2)
+	indexAll(l.Worker, pkgs[:20])
+
+	// the journal only has the last 5 of the 20 mutations
+	f := NewFollower(l.addr, NewMapStore())
+	stop := follow(t, f)
+	waitForSync(t, l, f)
+
+	stop()
+	indexAll(l.Worker, pkgs[20:])
+	follow(t, f)
+	waitForSync(t, l, f)
+}
+
+// Testing that snapshots taken while the leader keeps writing hold exactly the
+// mutations up to their sequence number, on stores whose readers don't hold
+// writers up as well as on the others
+func TestReplicationSnapshotWhileWriting(t *testing.T) {
+	for _, store := range []PackageStore{NewMapStore(), NewMVCCStore()} {
+		// every sync that falls behind by more than a mutation needs a snapshot
+		l := startLeaderStore(t, 1, store)
+		pkgs := testWorkload(300, 3, 4)
+		indexAll(l.Worker, pkgs[:100])
+
+		f := NewFollower(l.addr, NewMapStore())
+		follow(t, f)
+		indexAll(l.Worker, pkgs[100:])
+		waitForSync(t, l, f)
+	}
+}
+
+// Testing that a transfer slower than the timeout goes on as long as data
+// keeps coming
+func TestProgressConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	timeout := 50 * time.Millisecond
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(timeout / 5)
+			server.Write([]byte("x"))
+		}
+		time.Sleep(2 * timeout)
+		server.Write([]byte("late"))
+	}()
+
+	r := progressConn{Conn: client, timeout: timeout}
+	buf := make([]byte, 10)
+	if n, err := io.ReadFull(r, buf); err != nil || n != 10 {
+		t.Fatalf("expected 10 bytes over %s, got %d %v", 2*timeout, n, err)
+	}
+	if _, err := r.Read(buf); !isTimeout(err) {
+		t.Errorf("expected a timeout once the data stops, got %v", err)
+	}
+}
+
+// Testing that followers start over from a snapshot after a restore
+func TestReplicationRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup")
+
+	l := startLeader(t, 1000)
+	pkgs := testWorkload(50, 3, 3)
+	indexAll(l.Worker, pkgs[:10])
+	if err := SaveSnapshotFile(path, l.store); err != nil {
+		t.Fatal(err)
+	}
+	indexAll(l.Worker, pkgs[10:])
+
+	f := NewFollower(l.addr, NewMapStore())
+	follow(t, f)
+	waitForSync(t, l, f)
+
+	if err := l.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	l.Add(newPackage(pkgs[10]))
+	waitForSync(t, l, f)
+}
+
+// Testing that a read only server refuses writes
+func TestReadOnly(t *testing.T) {
+	m := NewMapStore()
+	(&Worker{store: m}).Add(&Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})})
+	send := serveWorker(t, &Worker{store: m, readOnly: true})
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{request: "QUERY|a|", expected: ResponseOK},
+		{request: "INDEX|b|", expected: ResponseError},
+		{request: "REMOVE|a|", expected: ResponseError},
+		{request: "FSCK|check|", expected: ResponseOK},
+		{request: "FSCK|repair|", expected: ResponseError},
+		{request: "RESTORE|backup|", expected: ResponseError},
+		{request: "QUERY|b|", expected: ResponseFail},
+	}
+	for _, test := range tests {
+		if response := send(test.request); response != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, response)
+		}
+	}
+}
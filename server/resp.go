@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	RESPIndex        = "PKG.INDEX"
+	RESPQuery        = "PKG.QUERY"
+	RESPRemove       = "PKG.REMOVE"
+	RESPDependencies = "PKG.DEPENDENCIES"
+	RESPDependents   = "PKG.DEPENDENTS"
+
+	// the longest bulk string read, as in Redis, so that a client can't make
+	// the server allocate any amount without a length limit
+	respMaxBulkLength = 512 << 20
+)
+
+// errRESPProtocol is returned for commands that aren't valid RESP
+var errRESPProtocol = errors.New("protocol error")
+
+// the protocol of Redis, see ServeRESP
+var respProtocol = protocol{serve: (*Worker).handleRESP, busy: "-BUSY no worker is free, try again later\r\n"}
+
+// ServeRESP is Serve for clients speaking RESP, the protocol of Redis, so that
+// redis-cli and other Redis tooling can be used on the index.
+//
+//	PKG.INDEX name [dependency ...]  1 if indexed, 0 if dependencies are missing
+//	PKG.QUERY name                   1 if indexed, 0 otherwise
+//	PKG.REMOVE name                  1 if removed, 0 if dependents are left
+//	PKG.DEPENDENCIES name            the names of the packages it depends on
+//	PKG.DEPENDENTS name              the names of the packages depending on it
+//	AUTH [username] token            see WithAuth, the username is ignored
+//	PING [message]
+//	QUIT
+//
+// Commands go through the same checks as INDEX, QUERY and REMOVE on the line
+// protocol, and answers other than OK and FAIL are errors, see respError.
+// Connections share the workers, the queue and the connection limits of the
+// line protocol.
+func (p *PackageIndexer) ServeRESP(ctx context.Context, ln net.Listener) error {
+	return p.serve(ctx, ln, respProtocol, &p.respLns)
+}
+
+func (w *Worker) handleRESP(conn net.Conn) {
+	defer w.conns.remove(conn)
+	reader := bufio.NewReader(conn)
+	// replies go through client, so that slow readers are cut off
+	client := w.connLimits.writer(conn)
+	s := w.newConnSession(conn)
+	for {
+		// the server is shutting down, the connection is closed between commands
+		if !w.conns.idle(conn) {
+			conn.Close()
+			return
+		}
+		args, err := w.connLimits.readCommand(conn, reader)
+
+		// an idle client isn't waiting for anything, and is cut off silently
+		if err == errIdle {
+			log.Printf("closing connection from %s: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			return
+		}
+		// a client too slow, sending too much or not speaking RESP is told so
+		// before being cut off
+		if err == ErrRequestTooLong || err == errRESPProtocol || isTimeout(err) {
+			log.Printf("closing connection from %s: %s", conn.RemoteAddr(), err.Error())
+			reply(client, respErr("ERR "+err.Error()))
+			conn.Close()
+			return
+		}
+		if err != nil {
+			log.Printf("error reading from client %s", err.Error())
+			if err := conn.Close(); err != nil {
+				log.Printf("error closing connection %s", err.Error())
+			}
+			return
+		}
+		if !w.conns.active(conn) {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if strings.ToUpper(args[0]) == "QUIT" {
+			reply(client, "+OK\r\n")
+			conn.Close()
+			return
+		}
+		reply(client, w.handleCommand(s, args))
+	}
+}
+
+// the number of arguments every command takes, at least and at most, -1 for
+// any number
+var respArity = map[string][2]int{
+	"PING":           {0, 1},
+	"AUTH":           {1, 2},
+	RESPIndex:        {1, -1},
+	RESPQuery:        {1, 1},
+	RESPRemove:       {1, 1},
+	RESPDependencies: {1, 1},
+	RESPDependents:   {1, 1},
+}
+
+// handleCommand runs a RESP command for the client of session s and returns
+// the reply
+func (w *Worker) handleCommand(s *session, args []string) string {
+	command := strings.ToUpper(args[0])
+	arity, ok := respArity[command]
+	if !ok {
+		return respErr(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	if n := len(args) - 1; n < arity[0] || (arity[1] >= 0 && n > arity[1]) {
+		return respErr(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+	}
+
+	switch command {
+	case "PING":
+		if len(args) == 2 {
+			return respBulk(args[1])
+		}
+		return "+PONG\r\n"
+
+	case "AUTH":
+		response := w.run(s, CmdAuth, args[len(args)-1], nil)
+		if response == ResponseDenied {
+			return respErr("WRONGPASS invalid username-password pair")
+		}
+		if response == ResponseOK {
+			return "+OK\r\n"
+		}
+		return respError(s, response)
+
+	case RESPIndex:
+		return respInteger(s, w.run(s, CmdIndex, args[1], args[2:]))
+
+	case RESPQuery:
+		return respInteger(s, w.run(s, CmdQuery, args[1], nil))
+
+	case RESPRemove:
+		return respInteger(s, w.run(s, CmdRemove, args[1], nil))
+	}
+
+	// PKG.DEPENDENCIES and PKG.DEPENDENTS, a null array if there is no such package
+	pkg, response := w.lookup(s, args[1])
+	if response == ResponseFail {
+		return "*-1\r\n"
+	}
+	if response != ResponseOK {
+		return respError(s, response)
+	}
+	if command == RESPDependencies {
+		return respArray(pkg.Dependencies())
+	}
+	return respArray(pkg.Dependents())
+}
+
+// readCommand reads the next command from r, reading from conn, either an array
+// of bulk strings or an inline command split on spaces. It waits like
+// readRequest, and the length limit counts the whole command.
+func (l ConnectionLimits) readCommand(conn net.Conn, r *bufio.Reader) ([]string, error) {
+	line, err := l.readRequest(conn, r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	read := len(line)
+	count := func(n int) error {
+		read += n
+		if l.MaxRequestLength > 0 && read > l.MaxRequestLength {
+			return ErrRequestTooLong
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 0 {
+		return nil, errRESPProtocol
+	}
+	var args []string
+	for i := 0; i < n; i++ {
+		header, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull || (err == nil && !strings.HasPrefix(string(header), "$")) {
+			return nil, errRESPProtocol
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := count(len(header)); err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(string(header[1:])))
+		if err != nil || length < 0 || length > respMaxBulkLength {
+			return nil, errRESPProtocol
+		}
+		if err := count(length + 2); err != nil {
+			return nil, err
+		}
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if string(arg[length:]) != "\r\n" {
+			return nil, errRESPProtocol
+		}
+		args = append(args, string(arg[:length]))
+	}
+	return args, nil
+}
+
+// respInteger returns the reply to a command answered with OK or FAIL on the
+// line protocol
+func respInteger(s *session, response string) string {
+	switch response {
+	case ResponseOK:
+		return ":1\r\n"
+	case ResponseFail:
+		return ":0\r\n"
+	}
+	return respError(s, response)
+}
+
+// respError returns the error reply for a response of the line protocol, with
+// the error codes Redis uses where it has one
+func respError(s *session, response string) string {
+	switch response {
+	case ResponseQuota:
+		return respErr("QUOTA the package goes over the server's limits")
+	case ResponseThrottled:
+		return respErr("THROTTLED too many requests, try again later")
+	case ResponseDenied:
+		if s.identity.Name == "" {
+			return respErr("NOAUTH Authentication required.")
+		}
+		return respErr(fmt.Sprintf("NOPERM %s is a %s", s.identity.Name, s.identity.Role))
+	case responseInvalid:
+		return respErr("ERR invalid package name or dependencies")
+	}
+	return respErr("ERR the server can't take the command right now")
+}
+
+func respErr(message string) string {
+	return "-" + message + "\r\n"
+}
+
+func respBulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(items []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(items))
+	for _, item := range items {
+		b.WriteString(respBulk(item))
+	}
+	return b.String()
+}
+
+// reply writes a RESP reply to the client
+func reply(conn net.Conn, r string) {
+	if _, err := conn.Write([]byte(r)); err != nil {
+		log.Printf("error writing to connection %s", err.Error())
+	}
+}
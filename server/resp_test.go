@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startRESP serves p over RESP and returns its address
+func startRESP(t *testing.T, p *PackageIndexer) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go p.ServeRESP(context.Background(), ln)
+	return ln.Addr().String()
+}
+
+// respClient sends commands as arrays of bulk strings, like redis-cli
+type respClient struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialRESP(t *testing.T, addr string) *respClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &respClient{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns the reply, see receive
+func (c *respClient) do(t *testing.T, args ...string) string {
+	fmt.Fprintf(c, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	reply, err := c.receive()
+	if err != nil {
+		t.Fatalf("%v: %s", args, err.Error())
+	}
+	return reply
+}
+
+// receive returns the next reply as it was sent, except for bulk strings that
+// are returned as their contents, and arrays that are returned as their header
+// followed by their elements, separated by spaces
+func (c *respClient) receive() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	n, _ := strconv.Atoi(line[1:])
+	switch {
+	case strings.HasPrefix(line, "$") && n >= 0:
+		bulk, err := c.r.ReadString('\n')
+		return strings.TrimSuffix(bulk, "\r\n"), err
+	case strings.HasPrefix(line, "*"):
+		items := []string{line}
+		for i := 0; i < n; i++ {
+			item, err := c.receive()
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+		}
+		return strings.Join(items, " "), nil
+	}
+	return line, nil
+}
+
+// Testing the RESP commands, and that they answer like the line protocol
+func TestRESP(t *testing.T) {
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0)
+	c := dialRESP(t, startRESP(t, p))
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hello"}, "hello"},
+		{[]string{"PKG.INDEX", "b", "a"}, ":0"},
+		{[]string{"PKG.INDEX", "a"}, ":1"},
+		{[]string{"pkg.index", "b", "a"}, ":1"},
+		{[]string{"PKG.INDEX", "c", "a", "b"}, ":1"},
+		{[]string{"PKG.QUERY", "b"}, ":1"},
+		{[]string{"PKG.QUERY", "missing"}, ":0"},
+		{[]string{"PKG.DEPENDENCIES", "c"}, "*2 a b"},
+		{[]string{"PKG.DEPENDENTS", "a"}, "*2 b c"},
+		{[]string{"PKG.DEPENDENTS", "c"}, "*0"},
+		{[]string{"PKG.DEPENDENCIES", "missing"}, "*-1"},
+		{[]string{"PKG.REMOVE", "a"}, ":0"},
+		{[]string{"PKG.REMOVE", "c"}, ":1"},
+		{[]string{"PKG.INDEX", "d|e"}, "-ERR invalid package name or dependencies"},
+		{[]string{"PKG.QUERY"}, "-ERR wrong number of arguments for 'pkg.query' command"},
+		{[]string{"PKG.QUERY", "a", "b"}, "-ERR wrong number of arguments for 'pkg.query' command"},
+		{[]string{"GET", "a"}, "-ERR unknown command 'GET'"},
+		{[]string{"AUTH", "token"}, "-ERR the server can't take the command right now"},
+	}
+	for _, test := range tests {
+		if reply := c.do(t, test.args...); reply != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.args, test.expected, reply)
+		}
+	}
+
+	// inline commands, as typed into telnet
+	fmt.Fprint(c, "PKG.QUERY b\r\n")
+	if reply, err := c.receive(); err != nil || reply != ":1" {
+		t.Errorf("expected :1 for an inline command, got %s %v", reply, err)
+	}
+	if reply := c.do(t, "QUIT"); reply != "+OK" {
+		t.Errorf("expected +OK to QUIT, got %s", reply)
+	}
+	if reply, err := c.receive(); err == nil {
+		t.Errorf("expected the connection to be closed after QUIT, got %s", reply)
+	}
+}
+
+// Testing that the package a QUERY found comes back with it, with its edges
+func TestLookup(t *testing.T) {
+	w := &Worker{store: NewMapStore()}
+	w.Index(NewPackage("a", nil))
+	w.Index(NewPackage("b", []string{"a"}))
+	s := w.newSession("")
+
+	pkg, response := w.lookup(s, "a")
+	if response != ResponseOK || pkg == nil || fmt.Sprint(pkg.Dependents()) != "[b]" {
+		t.Errorf("expected a with its dependent b, got %s %v", response, pkg)
+	}
+	if pkg, response := w.lookup(s, "c"); response != ResponseFail || pkg != nil {
+		t.Errorf("expected %s and no package, got %s %v", ResponseFail, response, pkg)
+	}
+	if _, response := w.lookup(s, "a|b"); response != responseInvalid {
+		t.Errorf("expected %s, got %s", responseInvalid, response)
+	}
+}
+
+// Testing that RESP clients authenticate like on the line protocol
+func TestRESPAuth(t *testing.T) {
+	credentials, err := writeCredentials(t, "ci writer writer-token", "reporting reader reader-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithAuth(credentials, RoleNone))
+	addr := startRESP(t, p)
+	reader, writer := dialRESP(t, addr), dialRESP(t, addr)
+
+	tests := []struct {
+		c        *respClient
+		args     []string
+		expected string
+	}{
+		{reader, []string{"PKG.QUERY", "a"}, "-NOAUTH Authentication required."},
+		{reader, []string{"AUTH", "wrong-token"}, "-WRONGPASS invalid username-password pair"},
+		{reader, []string{"AUTH", "default", "reader-token"}, "+OK"},
+		{reader, []string{"PKG.INDEX", "a"}, "-NOPERM reporting is a reader"},
+		{writer, []string{"AUTH", "writer-token"}, "+OK"},
+		{writer, []string{"PKG.INDEX", "a"}, ":1"},
+		{reader, []string{"PKG.QUERY", "a"}, ":1"},
+	}
+	for _, test := range tests {
+		if reply := test.c.do(t, test.args...); reply != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.args, test.expected, reply)
+		}
+	}
+}
+
+// Testing that commands over the length limit or not in RESP close the
+// connection, and that idle connections are closed without a reply
+func TestRESPLimits(t *testing.T) {
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithConnectionLimits(ConnectionLimits{IdleTimeout: 200 * time.Millisecond, MaxRequestLength: 64}))
+	addr := startRESP(t, p)
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"*2\r\n$9\r\nPKG.INDEX\r\n$100\r\n", "-ERR request too long"},
+		{"*1\r\n:1\r\n", "-ERR protocol error"},
+		{"*1\r\n$4\r\nPINGxx\r\n", "-ERR protocol error"},
+		{"*x\r\n", "-ERR protocol error"},
+	}
+	for _, test := range tests {
+		c := dialRESP(t, addr)
+		fmt.Fprint(c, test.request)
+		if reply, err := c.receive(); err != nil || reply != test.expected {
+			t.Errorf("%q: expected %s, got %s %v", test.request, test.expected, reply, err)
+		}
+		if reply, err := c.receive(); err == nil {
+			t.Errorf("%q: expected the connection to be closed, got %s", test.request, reply)
+		}
+	}
+
+	c := dialRESP(t, addr)
+	if reply, err := c.receive(); err != io.EOF {
+		t.Errorf("expected the idle connection to be closed, got %s %v", reply, err)
+	}
+}
+
+// Testing that RESP clients turned away get a RESP error
+func TestRESPBusy(t *testing.T) {
+	p := NewPackageIndexer(0, 1, NewMapStore(), 0)
+	addr := startRESP(t, p)
+	first := dialRESP(t, addr)
+	if reply := first.do(t, "PING"); reply != "+PONG" {
+		t.Fatalf("expected +PONG, got %s", reply)
+	}
+	if reply, err := dialRESP(t, addr).receive(); err != nil || !strings.HasPrefix(reply, "-BUSY") {
+		t.Errorf("expected -BUSY with no worker free, got %s %v", reply, err)
+	}
+}
+
+// Testing that Addr is the line protocol's address even when RESP is served
+// first, and that Shutdown stops RESP too
+func TestRESPAddr(t *testing.T) {
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	stoppedRESP := make(chan error, 1)
+	go func() { stoppedRESP <- p.ServeRESP(context.Background(), ln) }()
+	// an answer means the listener is being served
+	c := dialRESP(t, ln.Addr().String())
+	fmt.Fprint(c, "PING\r\n")
+	if reply, err := c.receive(); err != nil {
+		t.Fatalf("expected a reply, got %s %v", reply, err)
+	}
+
+	addr, stopped := startIndexer(t, p)
+	conn := dialIndexer(t, addr)
+	conn.send(t, "QUERY|a|")
+	if _, err := conn.receive(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Addr() == nil || p.Addr().String() != addr {
+		t.Errorf("expected %s, got %v", addr, p.Addr())
+	}
+	if addrs := p.Addrs(); len(addrs) != 1 {
+		t.Errorf("expected only %s, got %v", addr, addrs)
+	}
+
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, stopped := range []chan error{stopped, stoppedRESP} {
+		if err := <-stopped; err != ErrServerClosed {
+			t.Errorf("expected %v, got %v", ErrServerClosed, err)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pborman/uuid"
 )
@@ -14,127 +20,450 @@ const (
 	ResponseError = "ERROR"
 	ResponseOK    = "OK"
 	ResponseFail  = "FAIL"
+	ResponseQuota = "QUOTA"
+	// sent instead of serving a connection the server has no room for
+	ResponseBusy = "BUSY"
+	// sent for a bad token, or a command the client isn't allowed to run
+	ResponseDenied = "DENIED"
+	// sent instead of running a request over the client's rate limit
+	ResponseThrottled = "THROTTLED"
+
+	CmdIndex   = "INDEX"
+	CmdQuery   = "QUERY"
+	CmdRemove  = "REMOVE"
+	CmdFsck    = "FSCK"
+	CmdBackup  = "BACKUP"
+	CmdRestore = "RESTORE"
+	CmdDigest  = "DIGEST"
+	CmdAuth    = "AUTH"
+	CmdFetch   = "FETCH"
+
+	// FSCK modes, given in place of the package name
+	FsckCheck  = "check"
+	FsckRepair = "repair"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown
+var ErrServerClosed = errors.New("server closed")
 
-	CmdIndex  = "INDEX"
-	CmdQuery  = "QUERY"
-	CmdRemove = "REMOVE"
+const (
+	// how long to wait before accepting again after a temporary error,
+	// doubled every time it happens again in a row
+	acceptRetryMin = 5 * time.Millisecond
+	acceptRetryMax = time.Second
 )
 
-// PackageStore is the interface for storing packages
-type PackageStore interface {
-	Get(string) (*Package, bool)
-	Delete(string)
-	Put(*Package)
-	Size() int
-	Lock()
-	Unlock()
-	RLock()
-	RUnlock()
+// protocol is how workers talk with the clients of a listener
+type protocol struct {
+	// handles every request on a connection until it's closed
+	serve func(w *Worker, conn net.Conn)
+	// the answer to connections turned away
+	busy string
 }
 
-// mapStore is an implementation of PackageStore using a standard library map
-type mapStore struct {
-	l sync.RWMutex
-	m map[string]*Package
+// the line protocol, see the README
+var lineProtocol = protocol{serve: (*Worker).handleRequest, busy: ResponseBusy + "\n"}
+
+// NewWorker returns a worker that indexes packages into store
+func NewWorker(store PackageStore) *Worker {
+	return &Worker{id: uuid.New(), store: store, digests: &digestCache{}}
 }
 
-func (m *mapStore) Lock() {
-	m.l.Lock()
+// Option configures optional behaviour of a PackageIndexer
+type Option func(*PackageIndexer)
+
+// WithLimits bounds what clients can index, see Limits
+func WithLimits(limits Limits) Option {
+	return func(p *PackageIndexer) {
+		p.limits = limits
+	}
 }
 
-func (m *mapStore) Unlock() {
-	m.l.Unlock()
+// WithBackupDir sets the directory BACKUP and RESTORE read and write
+// snapshots in. Without it the commands are refused.
+func WithBackupDir(dir string) Option {
+	return func(p *PackageIndexer) {
+		p.backupDir = dir
+	}
 }
 
-func (m *mapStore) RLock() {
-	m.l.RLock()
+// WithJournal records every successful INDEX and REMOVE in journal, so that
+// they can be replicated, see ReplicationServer
+func WithJournal(journal *Journal) Option {
+	return func(p *PackageIndexer) {
+		p.journal = journal
+	}
+}
+
+// WithReadOnly refuses every command that would change the store, for
+// followers serving QUERY while a Follower keeps their store up to date
+func WithReadOnly() Option {
+	return func(p *PackageIndexer) {
+		p.readOnly = true
+	}
 }
 
-func (m *mapStore) RUnlock() {
-	m.l.RUnlock()
+// WithCluster makes every worker commit INDEX and REMOVE to the cluster node
+// and answer QUERY through it, see ClusterNode. Commands that would change the
+// store outside of the cluster are refused.
+func WithCluster(node *ClusterNode) Option {
+	return func(p *PackageIndexer) {
+		p.cluster = node
+	}
+}
+
+// WithMirror makes every worker forward INDEX and REMOVE to the mirror's
+// upstream, and read QUERY through it, see Mirror
+func WithMirror(mirror *Mirror) Option {
+	return func(p *PackageIndexer) {
+		p.mirror = mirror
+	}
+}
+
+// WithConnectionLimits bounds how long clients can take and how much they can
+// send, see ConnectionLimits
+func WithConnectionLimits(limits ConnectionLimits) Option {
+	return func(p *PackageIndexer) {
+		p.connLimits = limits
+	}
+}
+
+// WithTLS serves every connection over TLS with config, see NewTLSConfig
+func WithTLS(config *tls.Config) Option {
+	return func(p *PackageIndexer) {
+		p.tlsConfig = config
+	}
 }
 
-func (m *mapStore) Get(p string) (*Package, bool) {
-	pkg, ok := m.m[p]
-	return pkg, ok
+// WithAuth only lets clients run the commands their role allows, see Role.
+// Clients authenticate with AUTH and a token from credentials, until then
+// they have the anonymous role, RoleNone to require AUTH before anything else.
+func WithAuth(credentials *Credentials, anonymous Role) Option {
+	return func(p *PackageIndexer) {
+		p.credentials = credentials
+		p.anonymous = anonymous
+	}
 }
 
-func (m *mapStore) Delete(p string) {
-	delete(m.m, p)
+// WithRateLimits throttles clients making more requests than limits allow,
+// see RateLimits
+func WithRateLimits(limits RateLimits) Option {
+	return func(p *PackageIndexer) {
+		p.rateLimiter = NewRateLimiter(limits)
+	}
 }
 
-func (m *mapStore) Put(p *Package) {
-	m.m[p.name] = p
+// WithListenAddrs makes ListenAndServe listen on every one of addrs at once
+// instead of the indexer's port, see Listen
+func WithListenAddrs(addrs ...string) Option {
+	return func(p *PackageIndexer) {
+		p.listenAddrs = addrs
+	}
 }
 
-func (m *mapStore) Size() int {
-	return len(m.m)
+// WithSocketMode sets the permissions of the Unix domain sockets
+// ListenAndServe creates
+func WithSocketMode(mode os.FileMode) Option {
+	return func(p *PackageIndexer) {
+		p.socketMode = mode
+	}
 }
 
-func NewMapStore() *mapStore {
-	return &mapStore{
-		m: make(map[string]*Package),
+// WithQueueTimeout sets how long a connection waits for a worker before it's
+// answered with BUSY and closed. Without it, connections wait as long as it
+// takes.
+func WithQueueTimeout(timeout time.Duration) Option {
+	return func(p *PackageIndexer) {
+		p.queueTimeout = timeout
 	}
 }
 
-func NewPackageIndexer(rateLimit, numWorkers int, store PackageStore, port int) *PackageIndexer {
+// NewPackageIndexer returns an indexer serving up to maxConns connections at
+// once, with up to queueSize more waiting for a worker to be free. Connections
+// beyond that are answered with BUSY and closed.
+func NewPackageIndexer(queueSize, maxConns int, store PackageStore, port int, opts ...Option) *PackageIndexer {
 
 	p := &PackageIndexer{
-		conChan:    make(chan net.Conn, rateLimit),
-		workerChan: make(chan *Worker, numWorkers),
+		queue:      make(chan struct{}, queueSize),
+		workerChan: make(chan *Worker, maxConns),
 		port:       port,
+		store:      store,
+		conns:      newConnTracker(),
+		socketMode: DefaultSocketMode,
+		digests:    &digestCache{},
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
-	for i := 0; i < numWorkers; i++ {
-		p.workerChan <- &Worker{id: uuid.New(), store: store, workerChan: p.workerChan}
+	for i := 0; i < maxConns; i++ {
+		p.workerChan <- p.newWorker()
 	}
 	return p
 }
 
+// newWorker returns a worker configured like the indexer. Front ends other
+// than the line protocol each get one of their own, outside of the pool.
+func (p *PackageIndexer) newWorker() *Worker {
+	return &Worker{
+		id:          uuid.New(),
+		store:       p.store,
+		workerChan:  p.workerChan,
+		limits:      p.limits,
+		backupDir:   p.backupDir,
+		journal:     p.journal,
+		readOnly:    p.readOnly,
+		cluster:     p.cluster,
+		mirror:      p.mirror,
+		conns:       p.conns,
+		connLimits:  p.connLimits,
+		credentials: p.credentials,
+		anonymous:   p.anonymous,
+		rateLimiter: p.rateLimiter,
+		digests:     p.digests,
+	}
+}
+
 type Package struct {
 	name         string
 	dependents   map[string]interface{}
 	dependencies []string
 }
 
+// NewPackage returns a package with no dependents, ready to be added to a store
+func NewPackage(name string, dependencies []string) *Package {
+	if dependencies == nil {
+		dependencies = make([]string, 0)
+	}
+	return &Package{
+		name:         name,
+		dependencies: dependencies,
+		dependents:   make(map[string]interface{}),
+	}
+}
+
+// NewPackageWithDependents returns a package with the given dependents. It's
+// meant for stores and tests that need to put packages as they are, the
+// worker keeps dependents up to date by itself.
+func NewPackageWithDependents(name string, dependencies, dependents []string) *Package {
+	p := NewPackage(name, dependencies)
+	p.dependents = sliceToMap(dependents)
+	return p
+}
+
+func (p *Package) Name() string {
+	return p.name
+}
+
+func (p *Package) Dependencies() []string {
+	return p.dependencies
+}
+
+// Dependents returns the names of the packages that depend on p, sorted
+func (p *Package) Dependents() []string {
+	dependents := mapKeys(p.dependents)
+	sort.Strings(dependents)
+	return dependents
+}
+
+// copy returns a copy of the package that can be modified without affecting
+// the original. Packages held by a PackageStore must never be modified in place,
+// so that a rolled back transaction leaves them untouched.
+func (p *Package) copy() *Package {
+	dependents := make(map[string]interface{}, len(p.dependents))
+	for k, v := range p.dependents {
+		dependents[k] = v
+	}
+	return &Package{
+		name:         p.name,
+		dependents:   dependents,
+		dependencies: p.dependencies,
+	}
+}
+
 type Request struct {
 	command      string
 	pkg          string
 	dependencies []string
+	// the package QUERY found, for front ends that answer with it
+	found *Package
 }
 
 type PackageIndexer struct {
-	conChan    chan net.Conn
 	port       int
 	workers    []Worker
 	workerChan chan *Worker
+	limits     Limits
+	backupDir  string
+	journal    *Journal
+	readOnly   bool
+	cluster    *ClusterNode
+	mirror     *Mirror
+	store      PackageStore
+	conns      *connTracker
+	connLimits ConnectionLimits
+	tlsConfig  *tls.Config
+	// every command is allowed without credentials
+	credentials *Credentials
+	anonymous   Role
+	rateLimiter *RateLimiter
+	// the digest of the store, shared by every worker
+	digests *digestCache
+
+	// holds a token for every connection waiting for a worker
+	queue        chan struct{}
+	queueTimeout time.Duration
+	admission    admissionStats
+
+	// addresses ListenAndServe listens on, the port on every interface if empty
+	listenAddrs []string
+	socketMode  os.FileMode
+
+	l sync.Mutex
+	// every listener given to Serve, in order
+	lns []net.Listener
+	// every listener given to ServeRESP, kept apart so that Addr and Addrs
+	// only return line protocol addresses
+	respLns  []net.Listener
+	shutdown bool
 }
 
-func (p *PackageIndexer) ListenAndServe() {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p.port))
+// ListenAndServe listens on every address set with WithListenAddrs, or else
+// on the indexer's port, and serves connections on all of them until Shutdown
+// is called, see Serve. If any of the listeners fails, the others are closed
+// and its error is returned.
+func (p *PackageIndexer) ListenAndServe() error {
+	addrs := p.listenAddrs
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf(":%d", p.port)}
+	}
+	var lns []net.Listener
+	for _, addr := range addrs {
+		ln, err := Listen(addr, p.socketMode)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
 
-	if err != nil {
-		log.Fatalf("could not start tcp server: %s\n", err.Error())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) { errs <- p.Serve(ctx, ln) }(ln)
 	}
-	// use a buffered channel to rate limit connections
+	err := <-errs
+	cancel()
+	for range lns[1:] {
+		<-errs
+	}
+	return err
+}
+
+// Serve accepts connections on ln and hands each of them to a worker, until
+// ctx is cancelled or Shutdown is called. It returns ErrServerClosed after
+// Shutdown, ctx's error once ctx is cancelled, and otherwise the error that
+// stopped it accepting. Temporary accept errors, like running out of file
+// descriptors, are retried after a delay.
+//
+// With WithTLS, ln is wrapped so that every connection is served over TLS.
+//
+// Cancelling ctx closes ln, but connections already accepted are served until
+// they are closed, Shutdown also closes them.
+func (p *PackageIndexer) Serve(ctx context.Context, ln net.Listener) error {
+	return p.serve(ctx, ln, lineProtocol, &p.lns)
+}
+
+// serve accepts connections on ln and hands them to workers speaking proto,
+// see Serve. ln is added to lns, for Shutdown to close.
+func (p *PackageIndexer) serve(ctx context.Context, ln net.Listener, proto protocol, lns *[]net.Listener) error {
+	p.l.Lock()
+	if p.shutdown {
+		p.l.Unlock()
+		return ErrServerClosed
+	}
+	if p.tlsConfig != nil {
+		ln = tls.NewListener(ln, p.tlsConfig)
+	}
+	*lns = append(*lns, ln)
+	p.l.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
 	go func() {
-		for {
-			worker := <-p.workerChan
-			conn := <-p.conChan
-			go func() {
-				worker.handleRequest(conn)
-				p.workerChan <- worker
-			}()
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
 		}
 	}()
 
+	var delay time.Duration
 	for {
 		conn, err := ln.Accept()
 		//METRIC: increment total connections count
 		if err != nil {
-			log.Printf("error accepting connection: %s\n", err.Error())
+			if p.isShutdown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = acceptRetryMin
+				} else if delay < acceptRetryMax {
+					delay *= 2
+				}
+				log.Printf("error accepting connection: %s, retrying in %s\n", err.Error(), delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		if !p.conns.add(conn) {
+			conn.Close()
+			continue
 		}
-		p.conChan <- conn
+		p.admit(conn, proto)
+	}
+}
+
+// Addr returns the address the indexer is listening on for the line protocol,
+// nil if it isn't yet. With port 0 it's the port picked by the system. With
+// several listeners it's the address of the first one, see Addrs.
+func (p *PackageIndexer) Addr() net.Addr {
+	p.l.Lock()
+	defer p.l.Unlock()
+	if len(p.lns) == 0 {
+		return nil
+	}
+	return p.lns[0].Addr()
+}
+
+// Addrs returns the addresses of every listener the indexer served the line
+// protocol on
+func (p *PackageIndexer) Addrs() []net.Addr {
+	p.l.Lock()
+	defer p.l.Unlock()
+	addrs := make([]net.Addr, len(p.lns))
+	for i, ln := range p.lns {
+		addrs[i] = ln.Addr()
 	}
+	return addrs
+}
+
+func (p *PackageIndexer) isShutdown() bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.shutdown
 }
 
 func sliceToMap(s []string) map[string]interface{} {
@@ -154,34 +483,55 @@ func mapKeys(m map[string]interface{}) []string {
 	return s
 }
 
-// parses the request string
-func parseRequestString(s string) (*Request, bool) {
+// parses the request string, returning ErrInvalidRequest if it doesn't follow
+// the protocol or ErrQuotaExceeded if it goes over the limits
+func parseRequestString(s string, limits Limits) (*Request, error) {
 	splitRequest := strings.Split(s, "|")
 	if len(splitRequest) != 3 {
-		return nil, false
+		return nil, ErrInvalidRequest
 	}
 
-	command := splitRequest[0]
-	if command != CmdIndex && command != CmdQuery && command != CmdRemove {
-		//invalid command
-		return nil, false
+	deps := strings.TrimSpace(splitRequest[2])
+	dependencies := make([]string, 0)
+	if deps != "" {
+		dependencies = strings.Split(deps, ",")
 	}
+	return newRequest(splitRequest[0], splitRequest[1], dependencies, limits)
+}
 
-	pkg := splitRequest[1]
+// newRequest returns a request for command on pkg, returning
+// ErrInvalidRequest if it isn't a valid one or ErrQuotaExceeded if it goes
+// over the limits. Front ends other than the line protocol build their
+// requests with it, so that they accept the same ones.
+func newRequest(command, pkg string, dependencies []string, limits Limits) (*Request, error) {
+	if command != CmdIndex && command != CmdQuery && command != CmdRemove &&
+		command != CmdFsck && command != CmdBackup && command != CmdRestore &&
+		command != CmdDigest && command != CmdAuth && command != CmdFetch {
+		//invalid command
+		return nil, ErrInvalidRequest
+	}
 
-	if pkg == "" {
-		return nil, false
+	// names have to fit in a request line
+	if pkg == "" || strings.ContainsAny(pkg, "|\n") {
+		return nil, ErrInvalidRequest
+	}
+	for _, dep := range dependencies {
+		if strings.ContainsAny(dep, "|,\n") {
+			return nil, ErrInvalidRequest
+		}
 	}
 
-	deps := strings.TrimSpace(splitRequest[2])
-	dependencies := make([]string, 0)
-	if deps != "" {
-		dependencies = strings.Split(deps, ",")
+	// only INDEX adds to the index, everything else has to work on whatever is
+	// in it, and other commands' arguments aren't package names
+	if command == CmdIndex {
+		if err := limits.checkPackage(pkg, dependencies); err != nil {
+			return nil, err
+		}
 	}
 
 	return &Request{
 		command:      command,
 		pkg:          pkg,
 		dependencies: dependencies,
-	}, true
+	}, nil
 }
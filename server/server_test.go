@@ -1,8 +1,15 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -10,7 +17,7 @@ import (
 // Test adding packages
 func TestAdd(t *testing.T) {
 	m := NewMapStore()
-	p := NewPackageIndexer(1, m, 8080)
+	p := &Worker{store: m}
 
 	tests := []struct {
 		name         string
@@ -43,7 +50,7 @@ func TestAdd(t *testing.T) {
 	for _, test := range tests {
 		newPkg := &Package{name: test.name, dependents: make(map[string]interface{}), dependencies: test.dependencies}
 		success := p.Add(newPkg)
-		pkg := m.m[test.name]
+		pkg, _ := p.Get(test.name)
 		if success != test.success {
 			t.Errorf("expected %t, got %t", test.success, success)
 
@@ -61,7 +68,7 @@ func TestAdd(t *testing.T) {
 // Test querying packages
 func TestQuery(t *testing.T) {
 	m := NewMapStore()
-	p := NewPackageIndexer(1, m, 8080)
+	p := &Worker{store: m}
 
 	p.Add(&Package{name: "b", dependencies: make([]string, 0), dependents: make(map[string]interface{})})
 	tests := []struct {
@@ -94,7 +101,7 @@ func TestQuery(t *testing.T) {
 // Test removing packages
 func TestRemove(t *testing.T) {
 	m := NewMapStore()
-	p := NewPackageIndexer(1, m, 8080)
+	p := &Worker{store: m}
 
 	p.Add(&Package{name: "b", dependencies: []string{}, dependents: make(map[string]interface{})})
 	p.Add(&Package{name: "c", dependencies: []string{"b"}, dependents: make(map[string]interface{})})
@@ -132,7 +139,7 @@ func TestRemove(t *testing.T) {
 // Testing concurrent add, making sure that no dataraces occur
 func TestConcurrentAdd(t *testing.T) {
 	m := NewMapStore()
-	p := NewPackageIndexer(1, m, 8080)
+	p := &Worker{store: m}
 
 	a := &Package{
 		name:         "a",
@@ -186,14 +193,14 @@ func TestConcurrentAdd(t *testing.T) {
 
 	wg.Wait()
 
-	_, success := p.store.Get("e")
+	_, success := p.Get("e")
 
 	if !success {
 		t.Error("can't find e package")
 	}
 }
 
-func addWithWaitGroup(p *PackageIndexer, pkg *Package, wg *sync.WaitGroup) {
+func addWithWaitGroup(p *Worker, pkg *Package, wg *sync.WaitGroup) {
 	p.Add(pkg)
 	wg.Done()
 }
@@ -201,7 +208,7 @@ func addWithWaitGroup(p *PackageIndexer, pkg *Package, wg *sync.WaitGroup) {
 // Testing concurrent query and remove, making sure that no dataraces occur
 func TestConcurrentQueryRemove(t *testing.T) {
 	m := NewMapStore()
-	p := NewPackageIndexer(1, m, 8080)
+	p := &Worker{store: m}
 
 	a := &Package{
 		name:         "a",
@@ -267,6 +274,90 @@ func TestConcurrentQueryRemove(t *testing.T) {
 	wg.Wait()
 }
 
+// Testing that a failed update leaves the store untouched
+func TestUpdateRollback(t *testing.T) {
+	m := NewMapStore()
+	p := &Worker{store: m}
+
+	p.Add(&Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})})
+
+	err := m.Update(func(tx WriteTx) error {
+		tx.Put(&Package{name: "b", dependencies: []string{"a"}, dependents: make(map[string]interface{})})
+		if err := addDependents(tx, []string{"a"}, "b"); err != nil {
+			return err
+		}
+		tx.Delete("a")
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("expected update to return an error")
+	}
+
+	if _, ok := p.Get("b"); ok {
+		t.Error("expected b to be rolled back")
+	}
+	expected := &Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})}
+	if a, ok := p.Get("a"); !ok || !reflect.DeepEqual(a, expected) {
+		t.Errorf("expected %v, got %v", expected, a)
+	}
+}
+
+// serveWorker has w handle requests on one end of an in-memory connection, and
+// returns a function that sends a request on the other end and returns the response
+func serveWorker(t *testing.T, w *Worker) func(request string) string {
+	server, client := net.Pipe()
+	go w.handleRequest(server)
+	t.Cleanup(func() { client.Close() })
+
+	reader := bufio.NewReader(client)
+	return func(request string) string {
+		if _, err := fmt.Fprintln(client, request); err != nil {
+			t.Fatalf("error sending %s: %s", request, err.Error())
+		}
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading response to %s: %s", request, err.Error())
+		}
+		return strings.TrimSpace(response)
+	}
+}
+
+// Testing the BACKUP and RESTORE commands
+func TestBackupRestoreCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	send := serveWorker(t, &Worker{store: NewMapStore(), backupDir: dir})
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{request: "INDEX|a|", expected: ResponseOK},
+		{request: "BACKUP|monday|", expected: ResponseOK},
+		{request: "INDEX|b|a", expected: ResponseOK},
+		{request: "RESTORE|monday|", expected: ResponseOK},
+		{request: "QUERY|b|", expected: ResponseFail},
+		{request: "QUERY|a|", expected: ResponseOK},
+		{request: "RESTORE|tuesday|", expected: ResponseFail},
+		{request: "BACKUP|../monday|", expected: ResponseError},
+		{request: "RESTORE|..|", expected: ResponseError},
+	}
+
+	for _, test := range tests {
+		if response := send(test.request); response != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.request, test.expected, response)
+		}
+	}
+
+	send = serveWorker(t, &Worker{store: NewMapStore()})
+	if response := send("BACKUP|monday|"); response != ResponseError {
+		t.Errorf("expected BACKUP without a backup directory to be refused, got %s", response)
+	}
+}
+
 // Testing the request parsing
 func TestParseRequestString(t *testing.T) {
 	tests := []struct {
@@ -318,7 +409,8 @@ func TestParseRequestString(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result, success := parseRequestString(test.request)
+		result, err := parseRequestString(test.request, Limits{})
+		success := err == nil
 
 		if success == test.success && !reflect.DeepEqual(result, test.expected) {
 			t.Errorf("expected %v, got %v", test.expected, result)
@@ -326,6 +418,65 @@ func TestParseRequestString(t *testing.T) {
 	}
 }
 
+// Testing that requests over the limits are told apart from invalid ones
+func TestParseRequestStringLimits(t *testing.T) {
+	limits := Limits{MaxDependencies: 2, MaxNameLength: 3}
+	tests := []struct {
+		request  string
+		expected error
+	}{
+		{request: "INDEX|abc|d,e", expected: nil},
+		{request: "INDEX|abc|d,e,f", expected: ErrQuotaExceeded},
+		{request: "INDEX|abcd|", expected: ErrQuotaExceeded},
+		{request: "INDEX|abc|defg", expected: ErrQuotaExceeded},
+		{request: "INDEX|abcd", expected: ErrInvalidRequest},
+		// only INDEX is held to the limits
+		{request: "QUERY|abcd|", expected: nil},
+		{request: "REMOVE|abcd|", expected: nil},
+		{request: "AUTH|long-token|", expected: nil},
+		{request: "DIGEST|/0123|", expected: nil},
+	}
+
+	for _, test := range tests {
+		_, err := parseRequestString(test.request, limits)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.request, test.expected, err)
+		}
+	}
+}
+
+// Testing that the worker enforces the limits
+func TestIndexLimits(t *testing.T) {
+	p := &Worker{store: NewMapStore(), limits: Limits{MaxPackages: 2, MaxDependencies: 1, MaxNameLength: 3}}
+
+	tests := []struct {
+		name         string
+		dependencies []string
+		expected     error
+	}{
+		{name: "a", dependencies: []string{}, expected: nil},
+		{name: "b", dependencies: []string{"z"}, expected: ErrMissingDependency},
+		{name: "b", dependencies: []string{"a", "a"}, expected: ErrQuotaExceeded},
+		{name: "long", dependencies: []string{}, expected: ErrQuotaExceeded},
+		{name: "b", dependencies: []string{"a"}, expected: nil},
+		{name: "c", dependencies: []string{}, expected: ErrQuotaExceeded},
+		// indexing a package that is already there doesn't count
+		{name: "b", dependencies: []string{"a"}, expected: nil},
+	}
+
+	for _, test := range tests {
+		err := p.Index(&Package{name: test.name, dependencies: test.dependencies, dependents: make(map[string]interface{})})
+		if !errors.Is(err, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+
+	p.Remove("b")
+	if err := p.Index(&Package{name: "c", dependencies: []string{}, dependents: make(map[string]interface{})}); err != nil {
+		t.Errorf("expected room for c after removing b, got %v", err)
+	}
+}
+
 // Testing the mapKeys util function
 func TestMapKeys(t *testing.T) {
 	tests := []struct {
@@ -413,3 +564,106 @@ func TestSliceToMap(t *testing.T) {
 		}
 	}
 }
+
+// Testing that Serve stops accepting when its context is cancelled, and keeps
+// serving the connections it already has
+func TestServe(t *testing.T) {
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0)
+	if p.Addr() != nil {
+		t.Errorf("expected no address before serving, got %s", p.Addr())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- p.Serve(ctx, ln) }()
+
+	conn := dialIndexer(t, ln.Addr().String())
+	conn.send(t, "INDEX|a|")
+	if response, _ := conn.receive(); response != ResponseOK {
+		t.Errorf("expected %s, got %s", ResponseOK, response)
+	}
+	if p.Addr().String() != ln.Addr().String() {
+		t.Errorf("expected address %s, got %s", ln.Addr(), p.Addr())
+	}
+
+	cancel()
+	if err := <-stopped; err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("expected the listener to be closed")
+	}
+	conn.send(t, "QUERY|a|")
+	if response, _ := conn.receive(); response != ResponseOK {
+		t.Errorf("expected the open connection to be served, got %s", response)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails the first accepts with temporary errors, and then
+// with err once its real listener is closed
+type failingListener struct {
+	net.Listener
+	temporary int
+	err       error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.temporary > 0 {
+		l.temporary--
+		return nil, temporaryError{}
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, l.err
+	}
+	return conn, nil
+}
+
+// Testing that Serve retries temporary accept errors and returns the others
+func TestServeAcceptErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	boom := errors.New("boom")
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- p.Serve(context.Background(), &failingListener{Listener: ln, temporary: 3, err: boom})
+	}()
+
+	conn := dialIndexer(t, ln.Addr().String())
+	conn.send(t, "QUERY|a|")
+	if response, _ := conn.receive(); response != ResponseFail {
+		t.Errorf("expected %s after temporary errors, got %s", ResponseFail, response)
+	}
+
+	ln.Close()
+	if err := <-stopped; err != boom {
+		t.Errorf("expected %v, got %v", boom, err)
+	}
+}
+
+// Testing that ListenAndServe returns listen errors
+func TestListenAndServeError(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	p := NewPackageIndexer(10, 4, NewMapStore(), ln.Addr().(*net.TCPAddr).Port)
+	if err := p.ListenAndServe(); err == nil {
+		t.Error("expected an error listening on a port in use")
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// shardedStore is an implementation of PackageStore that stripes packages
+// across a fixed number of maps, each with its own lock, so that writes to
+// unrelated packages don't wait on each other. Transactions started with
+// ViewKeys or UpdateKeys only lock the shards of the given keys, always in
+// ascending shard order so that two transactions can never deadlock. View and
+// Update lock every shard.
+type shardedStore struct {
+	shards []*shard
+	// number of packages across all shards, plus the room transactions in
+	// progress reserved for the packages they add, kept up to date with atomic
+	// operations. Deletions only count once committed, so it's never less than
+	// what the store holds once every transaction in progress is done.
+	size int64
+	// write transactions committed, see GenerationStore
+	generation uint64
+}
+
+type shard struct {
+	l sync.RWMutex
+	m map[string]*Package
+}
+
+func NewShardedStore(n int) *shardedStore {
+	if n < 1 {
+		n = 1
+	}
+	s := &shardedStore{shards: make([]*shard, n)}
+	for i := range s.shards {
+		s.shards[i] = &shard{m: make(map[string]*Package)}
+	}
+	return s
+}
+
+func (s *shardedStore) shardFor(name string) int {
+	return int(hashName(name) % uint32(len(s.shards)))
+}
+
+// shardsFor returns the sorted, unique shard indexes for keys
+func (s *shardedStore) shardsFor(keys []string) []int {
+	idx := make([]int, len(keys))
+	for i, k := range keys {
+		idx[i] = s.shardFor(k)
+	}
+	sort.Ints(idx)
+
+	unique := idx[:0]
+	for i, v := range idx {
+		if i == 0 || v != idx[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+func (s *shardedStore) allShards() []int {
+	idx := make([]int, len(s.shards))
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
+
+func (s *shardedStore) View(fn func(tx ReadTx) error) error {
+	return s.view(s.allShards(), fn)
+}
+
+func (s *shardedStore) Update(fn func(tx WriteTx) error) error {
+	return s.update(s.allShards(), fn)
+}
+
+func (s *shardedStore) ViewKeys(keys []string, fn func(tx ReadTx) error) error {
+	return s.view(s.shardsFor(keys), fn)
+}
+
+func (s *shardedStore) UpdateKeys(keys []string, fn func(tx WriteTx) error) error {
+	return s.update(s.shardsFor(keys), fn)
+}
+
+func (s *shardedStore) view(idx []int, fn func(tx ReadTx) error) error {
+	for _, i := range idx {
+		s.shards[i].l.RLock()
+	}
+	defer func() {
+		for _, i := range idx {
+			s.shards[i].l.RUnlock()
+		}
+	}()
+	return fn(s.newTx(idx))
+}
+
+func (s *shardedStore) update(idx []int, fn func(tx WriteTx) error) error {
+	for _, i := range idx {
+		s.shards[i].l.Lock()
+	}
+	defer func() {
+		for _, i := range idx {
+			s.shards[i].l.Unlock()
+		}
+	}()
+
+	tx := s.newTx(idx)
+	tx.undo = make(map[string]*Package)
+	committed := false
+	// roll back on error as well as on panic
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	// give back the room reserved and not taken, and count the deletions
+	atomic.AddInt64(&s.size, int64(tx.growth-tx.reserved))
+	atomic.AddUint64(&s.generation, 1)
+	return nil
+}
+
+func (s *shardedStore) Generation() uint64 {
+	return atomic.LoadUint64(&s.generation)
+}
+
+func (s *shardedStore) newTx(idx []int) *shardedTx {
+	return &shardedTx{s: s, locked: idx, all: len(idx) == len(s.shards)}
+}
+
+// shardedTx is a transaction on a shardedStore over the shards in locked
+type shardedTx struct {
+	s *shardedStore
+	// sorted indexes of the shards held by the transaction
+	locked []int
+	all    bool
+	// the value each key had before the transaction, nil if it was absent
+	undo map[string]*Package
+	// packages added less packages deleted so far
+	growth int
+	// room taken in size for the packages added, at least growth
+	reserved int
+}
+
+// shard returns the shard holding p, which the transaction must have locked
+func (tx *shardedTx) shard(p string) *shard {
+	i := tx.s.shardFor(p)
+	if !tx.all && !tx.holds(i) {
+		panic(fmt.Sprintf("package %s is not covered by the transaction", p))
+	}
+	return tx.s.shards[i]
+}
+
+func (tx *shardedTx) holds(i int) bool {
+	for _, l := range tx.locked {
+		if l == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *shardedTx) Get(p string) (*Package, bool) {
+	pkg, ok := tx.shard(p).m[p]
+	return pkg, ok
+}
+
+// Size returns the number of packages, with the ones concurrent transactions
+// are adding
+func (tx *shardedTx) Size() int {
+	return int(atomic.LoadInt64(&tx.s.size)) - tx.reserved + tx.growth
+}
+
+// ForEach visits every shard, so it panics in a transaction that doesn't hold
+// them all, like Get for a package the transaction doesn't cover
+func (tx *shardedTx) ForEach(fn func(*Package) bool) {
+	if !tx.all {
+		panic("ForEach is not covered by a transaction over some keys")
+	}
+	for _, sh := range tx.s.shards {
+		for _, pkg := range sh.m {
+			if !fn(pkg) {
+				return
+			}
+		}
+	}
+}
+
+// reserveSize takes room for one more package if the store, counting the
+// packages concurrent transactions are adding, holds fewer than max, and
+// otherwise returns how many it holds. The room is given back if the
+// transaction doesn't add a package after all.
+func (tx *shardedTx) reserveSize(max int) (int, bool) {
+	if tx.growth < tx.reserved {
+		return 0, true
+	}
+	for {
+		size := atomic.LoadInt64(&tx.s.size)
+		if size >= int64(max) {
+			return int(size), false
+		}
+		if atomic.CompareAndSwapInt64(&tx.s.size, size, size+1) {
+			tx.reserved++
+			return 0, true
+		}
+	}
+}
+
+func (tx *shardedTx) Put(p *Package) {
+	tx.save(p.name)
+	tx.set(p.name, p)
+}
+
+func (tx *shardedTx) Delete(p string) {
+	tx.save(p)
+	tx.set(p, nil)
+}
+
+// set stores pkg under name, or deletes name if pkg is nil
+func (tx *shardedTx) set(name string, pkg *Package) {
+	sh := tx.shard(name)
+	_, existed := sh.m[name]
+	if pkg == nil {
+		delete(sh.m, name)
+		if existed {
+			tx.growth--
+		}
+		return
+	}
+	sh.m[name] = pkg
+	if !existed {
+		tx.growth++
+		// take room for the package, unless it was reserved already
+		if tx.growth > tx.reserved {
+			atomic.AddInt64(&tx.s.size, 1)
+			tx.reserved++
+		}
+	}
+}
+
+// save remembers the value of p before it is first changed
+func (tx *shardedTx) save(p string) {
+	if _, ok := tx.undo[p]; ok {
+		return
+	}
+	tx.undo[p] = tx.shard(p).m[p]
+}
+
+func (tx *shardedTx) rollback() {
+	for name, pkg := range tx.undo {
+		sh := tx.shard(name)
+		if pkg == nil {
+			delete(sh.m, name)
+			continue
+		}
+		sh.m[name] = pkg
+	}
+	atomic.AddInt64(&tx.s.size, -int64(tx.reserved))
+}
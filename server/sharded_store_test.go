@@ -0,0 +1,244 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testWorkload returns n packages forming a random dependency graph where each
+// package depends on up to maxDeps of the packages before it, roughly the shape
+// of the brew index used by the test suite
+func testWorkload(n, maxDeps int, seed int64) []*Package {
+	r := rand.New(rand.NewSource(seed))
+	pkgs := make([]*Package, n)
+	for i := range pkgs {
+		deps := make([]string, 0)
+		if i > 0 {
+			seen := make(map[int]bool)
+			for j := r.Intn(maxDeps + 1); j > 0; j-- {
+				d := r.Intn(i)
+				if !seen[d] {
+					seen[d] = true
+					deps = append(deps, pkgs[d].name)
+				}
+			}
+		}
+		pkgs[i] = &Package{name: fmt.Sprintf("pkg-%d", i), dependencies: deps}
+	}
+	return pkgs
+}
+
+// newPackage returns a fresh copy of pkg, ready to be added to a store
+func newPackage(pkg *Package) *Package {
+	return &Package{name: pkg.name, dependencies: pkg.dependencies, dependents: make(map[string]interface{})}
+}
+
+// Testing that the sharded store behaves like the map store for the worker
+func TestShardedStoreWorker(t *testing.T) {
+	p := &Worker{store: NewShardedStore(4)}
+
+	if !p.Add(&Package{name: "b", dependencies: []string{}, dependents: make(map[string]interface{})}) {
+		t.Fatal("expected b to be added")
+	}
+	if p.Add(&Package{name: "a", dependencies: []string{"b", "c"}, dependents: make(map[string]interface{})}) {
+		t.Error("expected a to fail with missing dependency c")
+	}
+	if !p.Add(&Package{name: "c", dependencies: []string{"b"}, dependents: make(map[string]interface{})}) {
+		t.Fatal("expected c to be added")
+	}
+	if p.Remove("b") {
+		t.Error("expected removing b to fail, c depends on it")
+	}
+	if !p.Query("b") || !p.Query("c") || p.Query("a") {
+		t.Error("unexpected query result")
+	}
+	if !p.Remove("c") || !p.Remove("b") {
+		t.Error("expected c and b to be removed")
+	}
+	if p.Query("b") {
+		t.Error("expected b to be gone")
+	}
+}
+
+// Testing that a transaction can't touch shards it hasn't locked
+func TestShardedStoreUncoveredKey(t *testing.T) {
+	s := NewShardedStore(64)
+	var other string
+	for i := 0; other == ""; i++ {
+		if k := fmt.Sprintf("pkg-%d", i); s.shardFor(k) != s.shardFor("a") {
+			other = k
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected reading an uncovered key to panic")
+		}
+	}()
+	s.ViewKeys([]string{"a"}, func(tx ReadTx) error {
+		tx.Get(other)
+		return nil
+	})
+}
+
+// Testing that ForEach panics in a transaction over some keys, instead of
+// visiting only the shards it holds
+func TestShardedStoreKeyedForEach(t *testing.T) {
+	s := NewShardedStore(64)
+	defer func() {
+		if recover() == nil {
+			t.Error("expected ForEach to panic")
+		}
+	}()
+	s.ViewKeys([]string{"a"}, func(tx ReadTx) error {
+		tx.ForEach(func(*Package) bool { return true })
+		return nil
+	})
+}
+
+// Testing that concurrent requests can't index more packages than the limit,
+// and that transactions rolled back give their room back
+func TestShardedStoreMaxPackages(t *testing.T) {
+	s := NewShardedStore(64)
+	w := &Worker{store: s, limits: Limits{MaxPackages: 50}}
+
+	var indexed int64
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if w.Index(NewPackage(fmt.Sprintf("pkg-%d-%d", g, i), nil)) == nil {
+					atomic.AddInt64(&indexed, 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if indexed != 50 || s.size != 50 {
+		t.Fatalf("expected 50 packages, got %d indexed and a size of %d", indexed, s.size)
+	}
+
+	// a removal rolled back leaves the store full
+	var name string
+	s.View(func(tx ReadTx) error {
+		tx.ForEach(func(p *Package) bool {
+			name = p.name
+			return false
+		})
+		return nil
+	})
+	s.UpdateKeys([]string{name}, func(tx WriteTx) error {
+		tx.Delete(name)
+		return errors.New("rolled back")
+	})
+	if err := w.Index(NewPackage("another", nil)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected %v, got %v", ErrQuotaExceeded, err)
+	}
+	// and an addition rolled back takes no room
+	if !w.Remove(name) {
+		t.Fatalf("expected %s to be removed", name)
+	}
+	s.UpdateKeys([]string{"rolled-back"}, func(tx WriteTx) error {
+		tx.Put(NewPackage("rolled-back", nil))
+		return errors.New("rolled back")
+	})
+	if err := w.Index(NewPackage("another", nil)); err != nil {
+		t.Errorf("expected room for another package, got %v", err)
+	}
+}
+
+// Testing concurrent indexing and removal on the sharded store, making sure that
+// no data races occur and reverse edges stay consistent
+func TestShardedStoreConcurrent(t *testing.T) {
+	s := NewShardedStore(8)
+	p := &Worker{store: s}
+	pkgs := testWorkload(200, 4, 1)
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 2000; i++ {
+				pkg := pkgs[r.Intn(len(pkgs))]
+				if r.Intn(2) == 0 {
+					p.Add(newPackage(pkg))
+				} else {
+					p.Remove(pkg.name)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	all := make(map[string]*Package)
+	for _, sh := range s.shards {
+		for k, v := range sh.m {
+			all[k] = v
+		}
+	}
+	if len(all) != int(s.size) {
+		t.Errorf("expected size %d, got %d", len(all), s.size)
+	}
+	for name, pkg := range all {
+		for _, dep := range pkg.dependencies {
+			d, ok := all[dep]
+			if !ok {
+				t.Errorf("%s is missing dependency %s", name, dep)
+				continue
+			}
+			if _, ok := d.dependents[name]; !ok {
+				t.Errorf("%s is missing dependent %s", dep, name)
+			}
+		}
+		for dependent := range pkg.dependents {
+			if _, ok := all[dependent]; !ok {
+				t.Errorf("%s has stale dependent %s", name, dependent)
+			}
+		}
+	}
+}
+
+// benchmarkStore runs a mix of INDEX, QUERY and REMOVE requests from many
+// concurrent clients against store
+func benchmarkStore(b *testing.B, store PackageStore) {
+	pkgs := testWorkload(1000, 5, 1)
+	p := &Worker{store: store}
+	for _, pkg := range pkgs {
+		p.Add(newPackage(pkg))
+	}
+	var seed int64
+
+	// roughly the 100 concurrent clients of the test suite
+	b.SetParallelism(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			pkg := pkgs[r.Intn(len(pkgs))]
+			switch r.Intn(3) {
+			case 0:
+				p.Add(newPackage(pkg))
+			case 1:
+				p.Query(pkg.name)
+			case 2:
+				p.Remove(pkg.name)
+			}
+		}
+	})
+}
+
+func BenchmarkMapStore(b *testing.B) {
+	benchmarkStore(b, NewMapStore())
+}
+
+func BenchmarkShardedStore(b *testing.B) {
+	benchmarkStore(b, NewShardedStore(DefaultShards))
+}
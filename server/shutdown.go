@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// how often Shutdown checks whether every connection is gone
+const shutdownPollInterval = 50 * time.Millisecond
+
+type connState int
+
+const (
+	// waiting for the next request
+	connIdle connState = iota
+	// handling a request
+	connActive
+	// closed by Shutdown
+	connClosed
+)
+
+// connTracker keeps track of open connections, so that Shutdown can close the
+// idle ones straight away and wait for the others to finish their request. A
+// nil tracker tracks nothing.
+type connTracker struct {
+	l       sync.Mutex
+	conns   map[net.Conn]connState
+	closing bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]connState)}
+}
+
+// add starts tracking a new connection, and returns false if the server is
+// shutting down and it should be closed instead
+func (t *connTracker) add(conn net.Conn) bool {
+	if t == nil {
+		return true
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[conn] = connIdle
+	return true
+}
+
+// idle marks the connection as waiting for a request, and returns false if it
+// should be closed instead
+func (t *connTracker) idle(conn net.Conn) bool {
+	if t == nil {
+		return true
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.closing || t.conns[conn] == connClosed {
+		return false
+	}
+	t.conns[conn] = connIdle
+	return true
+}
+
+// active marks the connection as handling a request, and returns false if
+// Shutdown closed it in the meantime, in which case the request is dropped
+func (t *connTracker) active(conn net.Conn) bool {
+	if t == nil {
+		return true
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	if t.conns[conn] == connClosed {
+		return false
+	}
+	t.conns[conn] = connActive
+	return true
+}
+
+// remove stops tracking a connection once it's closed
+func (t *connTracker) remove(conn net.Conn) {
+	if t == nil {
+		return
+	}
+	t.l.Lock()
+	defer t.l.Unlock()
+	delete(t.conns, conn)
+}
+
+// closeIdle refuses new connections, closes the idle ones and returns how many
+// are left
+func (t *connTracker) closeIdle() int {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.closing = true
+	for conn, state := range t.conns {
+		if state == connIdle {
+			conn.Close()
+			t.conns[conn] = connClosed
+		}
+	}
+	return len(t.conns)
+}
+
+// closeAll closes every connection, whatever it's doing
+func (t *connTracker) closeAll() {
+	t.l.Lock()
+	defer t.l.Unlock()
+	t.closing = true
+	for conn := range t.conns {
+		conn.Close()
+		t.conns[conn] = connClosed
+	}
+}
+
+// Shutdown stops the server without interrupting any request. It stops
+// accepting connections, closes the ones waiting for a request, and waits for
+// the others to finish the request they are handling before closing them too.
+//
+// If ctx ends first, the remaining connections are closed whatever they are
+// doing, and ctx's error is returned.
+func (p *PackageIndexer) Shutdown(ctx context.Context) error {
+	p.l.Lock()
+	lns := append(append([]net.Listener{}, p.lns...), p.respLns...)
+	p.shutdown = true
+	p.l.Unlock()
+	for _, ln := range lns {
+		ln.Close()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for p.conns.closeIdle() > 0 {
+		select {
+		case <-ctx.Done():
+			p.conns.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowStore holds every write until it's released
+type slowStore struct {
+	PackageStore
+	release chan struct{}
+}
+
+func (s *slowStore) Update(fn func(tx WriteTx) error) error {
+	<-s.release
+	return s.PackageStore.Update(fn)
+}
+
+// startIndexer serves p on a random port and returns its address, and a
+// channel that gets what Serve returns
+func startIndexer(t *testing.T, p *PackageIndexer) (string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	stopped := make(chan error, 1)
+	go func() { stopped <- p.Serve(context.Background(), ln) }()
+	return ln.Addr().String(), stopped
+}
+
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialIndexer(t *testing.T, addr string) *testConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testConn) send(t *testing.T, request string) {
+	if _, err := fmt.Fprintln(c, request); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testConn) receive() (string, error) {
+	response, err := c.r.ReadString('\n')
+	return strings.TrimSpace(response), err
+}
+
+// Testing that Shutdown lets requests in progress finish and closes the rest
+func TestShutdown(t *testing.T) {
+	store := &slowStore{PackageStore: NewMapStore(), release: make(chan struct{})}
+	p := NewPackageIndexer(10, 4, store, 0)
+	addr, stopped := startIndexer(t, p)
+
+	idle := dialIndexer(t, addr)
+	idle.send(t, "QUERY|a|")
+	if response, _ := idle.receive(); response != ResponseFail {
+		t.Fatalf("expected %s, got %s", ResponseFail, response)
+	}
+	busy := dialIndexer(t, addr)
+	busy.send(t, "INDEX|a|")
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- p.Shutdown(context.Background()) }()
+
+	if _, err := idle.receive(); err == nil {
+		t.Error("expected the idle connection to be closed")
+	}
+	select {
+	case err := <-stopped:
+		if err != ErrServerClosed {
+			t.Errorf("expected %v, got %v", ErrServerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("expected new connections to be refused")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("expected Shutdown to wait for the request in progress, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(store.release)
+	if response, err := busy.receive(); response != ResponseOK {
+		t.Errorf("expected the request in progress to finish, got %q %v", response, err)
+	}
+	if _, err := busy.receive(); err == nil {
+		t.Error("expected the connection to be closed after its request")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+// Testing that Shutdown gives up on requests that take too long
+func TestShutdownTimeout(t *testing.T) {
+	store := &slowStore{PackageStore: NewMapStore(), release: make(chan struct{})}
+	defer close(store.release)
+	p := NewPackageIndexer(10, 4, store, 0)
+	addr, _ := startIndexer(t, p)
+
+	busy := dialIndexer(t, addr)
+	busy.send(t, "INDEX|a|")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if _, err := busy.receive(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SnapshotVersion is the version of the snapshot format written by WriteSnapshot
+const SnapshotVersion = 1
+
+const (
+	snapshotHeader   = "package-indexer snapshot"
+	snapshotChecksum = "sha256"
+)
+
+var ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+// snapshotPackage is how a package is written in a snapshot. Both directions of
+// every edge are kept so that a snapshot can be checked as it is.
+type snapshotPackage struct {
+	Name         string   `json:"name"`
+	Dependencies []string `json:"dependencies"`
+	Dependents   []string `json:"dependents"`
+}
+
+// WriteSnapshot writes every package in tx to w. A snapshot is a header line
+// with the format version, then one JSON object per package sorted by name, and
+// finally the sha256 checksum of everything before it.
+func WriteSnapshot(w io.Writer, tx ReadTx) error {
+	pkgs := make([]*Package, 0, tx.Size())
+	tx.ForEach(func(pkg *Package) bool {
+		pkgs = append(pkgs, pkg)
+		return true
+	})
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].name < pkgs[j].name })
+
+	h := sha256.New()
+	bw := bufio.NewWriter(w)
+	body := io.MultiWriter(bw, h)
+
+	if _, err := fmt.Fprintf(body, "%s %d\n", snapshotHeader, SnapshotVersion); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(body)
+	for _, pkg := range pkgs {
+		dependents := mapKeys(pkg.dependents)
+		sort.Strings(dependents)
+		err := enc.Encode(snapshotPackage{
+			Name:         pkg.name,
+			Dependencies: pkg.dependencies,
+			Dependents:   dependents,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(bw, "%s %s\n", snapshotChecksum, hex.EncodeToString(h.Sum(nil))); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot and puts its packages
+// into tx exactly as they are, without checking them, so that a damaged store
+// can still be loaded and looked at. It returns an error if the snapshot is of
+// an unknown version or its checksum doesn't match, in which case some of the
+// packages may already have been put.
+func ReadSnapshot(r io.Reader, tx WriteTx) error {
+	br := bufio.NewReader(r)
+	h := sha256.New()
+
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading snapshot header: %s", err.Error())
+	}
+	var version int
+	if _, err := fmt.Sscanf(header, snapshotHeader+" %d\n", &version); err != nil {
+		return fmt.Errorf("not a snapshot: %q", strings.TrimSpace(header))
+	}
+	if version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	h.Write([]byte(header))
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("error reading snapshot, is it truncated? %s", err.Error())
+		}
+
+		if bytes.HasPrefix(line, []byte(snapshotChecksum+" ")) {
+			sum := strings.TrimSpace(strings.TrimPrefix(string(line), snapshotChecksum+" "))
+			if sum != hex.EncodeToString(h.Sum(nil)) {
+				return ErrSnapshotChecksum
+			}
+			return nil
+		}
+		h.Write(line)
+
+		var p snapshotPackage
+		if err := json.Unmarshal(line, &p); err != nil {
+			return fmt.Errorf("error reading snapshot: %s", err.Error())
+		}
+		if p.Dependencies == nil {
+			p.Dependencies = make([]string, 0)
+		}
+		tx.Put(&Package{
+			name:         p.Name,
+			dependencies: p.Dependencies,
+			dependents:   sliceToMap(p.Dependents),
+		})
+	}
+}
+
+// LoadSnapshotFile reads the snapshot at path into store in a single
+// transaction, so nothing is loaded if the snapshot is damaged
+func LoadSnapshotFile(path string, store PackageStore) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.Update(func(tx WriteTx) error {
+		return ReadSnapshot(f, tx)
+	})
+}
+
+// SaveSnapshotFile writes a snapshot of store to path. The snapshot is written
+// to a temporary file next to path first and renamed over it once complete, so
+// path always holds a whole snapshot.
+func SaveSnapshotFile(path string, store PackageStore) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = store.View(func(tx ReadTx) error {
+		return WriteSnapshot(f, tx)
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// RestoreSnapshotFile replaces everything in store with the snapshot at path.
+// The snapshot is read and checked in full before the store is touched, and is
+// rejected if it is damaged or its packages aren't consistent. The swap itself
+// happens in a single transaction, so other requests see either the old
+// packages or the restored ones, never a mix.
+func RestoreSnapshotFile(path string, store PackageStore) error {
+	restored, err := readRestore(path)
+	if err != nil {
+		return err
+	}
+	return store.Update(func(tx WriteTx) error {
+		replaceAll(tx, restored)
+		return nil
+	})
+}
+
+// readRestore reads the snapshot at path into a new store, and checks that its
+// packages are consistent
+func readRestore(path string) (*mapStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readConsistentSnapshot(f)
+}
+
+// readConsistentSnapshot reads a snapshot into a new store, and checks that its
+// packages are consistent
+func readConsistentSnapshot(r io.Reader) (*mapStore, error) {
+	restored := NewMapStore()
+	err := restored.Update(func(tx WriteTx) error {
+		return ReadSnapshot(r, tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	restored.View(func(tx ReadTx) error {
+		problems = Check(tx)
+		return nil
+	})
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("snapshot is inconsistent, %d problems starting with %s", len(problems), problems[0])
+	}
+	return restored, nil
+}
+
+// replaceAll deletes every package in tx and puts the packages of src instead
+func replaceAll(tx WriteTx, src *mapStore) {
+	names := make([]string, 0, tx.Size())
+	tx.ForEach(func(pkg *Package) bool {
+		names = append(names, pkg.name)
+		return true
+	})
+	for _, name := range names {
+		tx.Delete(name)
+	}
+	for _, pkg := range src.m {
+		tx.Put(pkg)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Testing that a snapshot reads back into the same packages, broken ones included
+func TestSnapshot(t *testing.T) {
+	src := brokenStore()
+	p := &Worker{store: src}
+	p.Add(&Package{name: "e", dependencies: []string{"a", "b"}, dependents: make(map[string]interface{})})
+
+	var buf bytes.Buffer
+	src.View(func(tx ReadTx) error {
+		return WriteSnapshot(&buf, tx)
+	})
+
+	dst := NewMapStore()
+	err := dst.Update(func(tx WriteTx) error {
+		return ReadSnapshot(bytes.NewReader(buf.Bytes()), tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dst.m, src.m) {
+		t.Errorf("expected %v, got %v", src.m, dst.m)
+	}
+}
+
+// Testing that damaged snapshots are rejected and nothing is loaded
+func TestSnapshotDamaged(t *testing.T) {
+	var buf bytes.Buffer
+	brokenStore().View(func(tx ReadTx) error {
+		return WriteSnapshot(&buf, tx)
+	})
+	good := buf.String()
+
+	tests := []string{
+		strings.Replace(good, `"name":"b"`, `"name":"x"`, 1),
+		good[:len(good)-80],
+		strings.Replace(good, "snapshot 1", "snapshot 9", 1),
+		"INDEX|a|\n",
+	}
+
+	for _, test := range tests {
+		m := NewMapStore()
+		err := m.Update(func(tx WriteTx) error {
+			return ReadSnapshot(strings.NewReader(test), tx)
+		})
+		if err == nil {
+			t.Errorf("expected an error reading %q", test)
+		}
+		if len(m.m) != 0 {
+			t.Errorf("expected nothing to be loaded, got %v", m.m)
+		}
+	}
+}
+
+// Testing that a restore replaces the store and a damaged backup is rejected
+func TestRestoreSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup")
+
+	m := NewMapStore()
+	p := &Worker{store: m}
+	p.Add(&Package{name: "a", dependencies: []string{}, dependents: make(map[string]interface{})})
+	p.Add(&Package{name: "b", dependencies: []string{"a"}, dependents: make(map[string]interface{})})
+	if err := SaveSnapshotFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	backedUp := make(map[string]*Package)
+	for k, v := range m.m {
+		backedUp[k] = v
+	}
+
+	p.Remove("b")
+	p.Add(&Package{name: "c", dependencies: []string{"a"}, dependents: make(map[string]interface{})})
+	if err := RestoreSnapshotFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.m, backedUp) {
+		t.Errorf("expected %v, got %v", backedUp, m.m)
+	}
+
+	// flip a byte in the middle of the backup
+	data, _ := ioutil.ReadFile(path)
+	data[len(data)/2] ^= 1
+	ioutil.WriteFile(path, data, 0644)
+	p.Remove("b")
+	if err := RestoreSnapshotFile(path, m); err == nil {
+		t.Error("expected a damaged backup to be rejected")
+	}
+	if _, ok := m.m["b"]; ok || len(m.m) != 1 {
+		t.Errorf("expected the store to be left alone, got %v", m.m)
+	}
+
+	// an intact but inconsistent snapshot is rejected too
+	SaveSnapshotFile(path, brokenStore())
+	if err := RestoreSnapshotFile(path, m); err == nil {
+		t.Error("expected an inconsistent backup to be rejected")
+	}
+}
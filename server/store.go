@@ -0,0 +1,236 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ReadTx is a read only view of a PackageStore. It is only valid inside the
+// function passed to View or Update.
+type ReadTx interface {
+	Get(string) (*Package, bool)
+	Size() int
+	// ForEach calls fn for every package until fn returns false. fn must not
+	// modify the store.
+	ForEach(fn func(*Package) bool)
+}
+
+// WriteTx is a read/write view of a PackageStore. It is only valid inside the
+// function passed to Update.
+type WriteTx interface {
+	ReadTx
+	Put(*Package)
+	Delete(string)
+}
+
+// PackageStore is the interface for storing packages. All access happens inside
+// transactions: View for reads and Update for writes. If the function passed to
+// Update returns an error, every change it made is rolled back and the error is
+// returned to the caller.
+//
+// Packages returned by a transaction must not be modified in place, put a
+// modified copy instead.
+type PackageStore interface {
+	View(func(tx ReadTx) error) error
+	Update(func(tx WriteTx) error) error
+}
+
+// mapStore is an implementation of PackageStore using a standard library map
+type mapStore struct {
+	l sync.RWMutex
+	m map[string]*Package
+	// write transactions committed, see GenerationStore
+	generation uint64
+}
+
+func NewMapStore() *mapStore {
+	return &mapStore{
+		m: make(map[string]*Package),
+	}
+}
+
+func (m *mapStore) View(fn func(tx ReadTx) error) error {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return fn(&mapTx{m: m.m})
+}
+
+func (m *mapStore) Update(fn func(tx WriteTx) error) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	tx := &mapTx{m: m.m, undo: make(map[string]*Package)}
+	committed := false
+	// roll back on error as well as on panic
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	atomic.AddUint64(&m.generation, 1)
+	return nil
+}
+
+func (m *mapStore) Generation() uint64 {
+	return atomic.LoadUint64(&m.generation)
+}
+
+// mapTx is a transaction on a mapStore. Writes go straight to the map, and the
+// previous value of every key is kept so that they can be undone.
+type mapTx struct {
+	m map[string]*Package
+	// the value each key had before the transaction, nil if it was absent
+	undo map[string]*Package
+}
+
+func (tx *mapTx) Get(p string) (*Package, bool) {
+	pkg, ok := tx.m[p]
+	return pkg, ok
+}
+
+func (tx *mapTx) Size() int {
+	return len(tx.m)
+}
+
+func (tx *mapTx) ForEach(fn func(*Package) bool) {
+	for _, pkg := range tx.m {
+		if !fn(pkg) {
+			return
+		}
+	}
+}
+
+func (tx *mapTx) Put(p *Package) {
+	tx.save(p.name)
+	tx.m[p.name] = p
+}
+
+func (tx *mapTx) Delete(p string) {
+	tx.save(p)
+	delete(tx.m, p)
+}
+
+// save remembers the value of p before it is first changed
+func (tx *mapTx) save(p string) {
+	if _, ok := tx.undo[p]; ok {
+		return
+	}
+	tx.undo[p] = tx.m[p]
+}
+
+func (tx *mapTx) rollback() {
+	for name, pkg := range tx.undo {
+		if pkg == nil {
+			delete(tx.m, name)
+			continue
+		}
+		tx.m[name] = pkg
+	}
+}
+
+// KeyedStore is implemented by stores that can lock less than the whole store
+// when the packages a transaction will touch are known up front. The function
+// passed to ViewKeys or UpdateKeys must only touch the packages named in keys,
+// and can't call ForEach. Size counts packages that concurrent transactions
+// are adding as well.
+type KeyedStore interface {
+	PackageStore
+	ViewKeys(keys []string, fn func(tx ReadTx) error) error
+	UpdateKeys(keys []string, fn func(tx WriteTx) error) error
+}
+
+// viewKeys runs fn in a read transaction covering keys, falling back to a
+// transaction over the whole store if the store is not a KeyedStore
+func viewKeys(store PackageStore, keys []string, fn func(tx ReadTx) error) error {
+	if ks, ok := store.(KeyedStore); ok {
+		return ks.ViewKeys(keys, fn)
+	}
+	return store.View(fn)
+}
+
+// updateKeys runs fn in a write transaction covering keys, falling back to a
+// transaction over the whole store if the store is not a KeyedStore
+func updateKeys(store PackageStore, keys []string, fn func(tx WriteTx) error) error {
+	if ks, ok := store.(KeyedStore); ok {
+		return ks.UpdateKeys(keys, fn)
+	}
+	return store.Update(fn)
+}
+
+// VersionedStore is a PackageStore whose View doesn't hold off writers, and that
+// instead hands out versions of the store that stay the same for as long as
+// they are held
+type VersionedStore interface {
+	PackageStore
+	// Version calls at with no write transaction in progress, and returns the
+	// version of the store at that point
+	Version(at func()) ReadTx
+}
+
+// consistentView runs fn on a read transaction of store, after running at at a
+// point where no write transaction is in progress, so that at sees exactly the
+// writes fn does. Only VersionedStores let writers carry on meanwhile.
+func consistentView(store PackageStore, at func(), fn func(tx ReadTx) error) error {
+	if vs, ok := store.(VersionedStore); ok {
+		return fn(vs.Version(at))
+	}
+	return store.View(func(tx ReadTx) error {
+		at()
+		return fn(tx)
+	})
+}
+
+// GenerationStore is a PackageStore that counts the write transactions
+// committed to it, so that whatever is worked out from its packages can be
+// kept until they change. The count goes up before the transaction's changes
+// can be seen.
+type GenerationStore interface {
+	PackageStore
+	Generation() uint64
+}
+
+const (
+	StoreMap      = "map"
+	StoreSharded  = "sharded"
+	StoreMVCC     = "mvcc"
+	StoreInterned = "interned"
+
+	// DefaultShards is the number of shards used by NewStore for a sharded store
+	DefaultShards = 64
+)
+
+// hashName hashes a package name with 32 bit FNV-1a, inlined to avoid
+// allocating a hash.Hash32 on every lookup
+func hashName(name string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= prime32
+	}
+	return h
+}
+
+// NewStore returns an empty PackageStore of the given kind
+func NewStore(kind string) (PackageStore, error) {
+	switch kind {
+	case StoreMap:
+		return NewMapStore(), nil
+	case StoreSharded:
+		return NewShardedStore(DefaultShards), nil
+	case StoreMVCC:
+		return NewMVCCStore(), nil
+	case StoreInterned:
+		return NewInternedStore(), nil
+	}
+	return nil, fmt.Errorf("unknown store %q", kind)
+}
@@ -0,0 +1,24 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/john-cai/package-indexer/server"
+	"github.com/john-cai/package-indexer/server/storetest"
+)
+
+func TestMapStoreConformance(t *testing.T) {
+	storetest.Run(t, func() server.PackageStore { return server.NewMapStore() })
+}
+
+func TestShardedStoreConformance(t *testing.T) {
+	storetest.Run(t, func() server.PackageStore { return server.NewShardedStore(8) })
+}
+
+func TestMVCCStoreConformance(t *testing.T) {
+	storetest.Run(t, func() server.PackageStore { return server.NewMVCCStore() })
+}
+
+func TestInternedStoreConformance(t *testing.T) {
+	storetest.Run(t, func() server.PackageStore { return server.NewInternedStore() })
+}
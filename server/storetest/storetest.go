@@ -0,0 +1,366 @@
+// Package storetest is a conformance suite for implementations of
+// server.PackageStore. A store that passes it can be used by the indexer in
+// place of the built in ones:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func() server.PackageStore { return NewMyStore() })
+//	}
+//
+// Run the suite with -race, some of the tests are only meaningful with the
+// race detector on.
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/john-cai/package-indexer/server"
+)
+
+// Run runs every conformance test against stores returned by newStore, which
+// must return a new, empty store on every call
+func Run(t *testing.T, newStore func() server.PackageStore) {
+	tests := []struct {
+		name string
+		test func(*testing.T, server.PackageStore)
+	}{
+		{"GetPutDelete", testGetPutDelete},
+		{"ReadYourWrites", testReadYourWrites},
+		{"Rollback", testRollback},
+		{"RollbackOnPanic", testRollbackOnPanic},
+		{"ForEach", testForEach},
+		{"KeyedTransactions", testKeyedTransactions},
+		{"ReverseEdges", testReverseEdges},
+		{"Concurrent", testConcurrent},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newStore())
+		})
+	}
+}
+
+// put puts every package in a single transaction
+func put(t *testing.T, store server.PackageStore, pkgs ...*server.Package) {
+	err := store.Update(func(tx server.WriteTx) error {
+		for _, pkg := range pkgs {
+			tx.Put(pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error putting packages: %s", err.Error())
+	}
+}
+
+// contents returns the name, dependencies and dependents of every package
+// in the store
+func contents(t *testing.T, store server.PackageStore) map[string][2][]string {
+	c := make(map[string][2][]string)
+	err := store.View(func(tx server.ReadTx) error {
+		tx.ForEach(func(pkg *server.Package) bool {
+			c[pkg.Name()] = describe(pkg)
+			return true
+		})
+		if tx.Size() != len(c) {
+			t.Errorf("expected size %d, got %d", len(c), tx.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error reading store: %s", err.Error())
+	}
+	return c
+}
+
+// describe returns the dependencies and dependents of pkg in a comparable form
+func describe(pkg *server.Package) [2][]string {
+	deps := append([]string{}, pkg.Dependencies()...)
+	sort.Strings(deps)
+	return [2][]string{deps, pkg.Dependents()}
+}
+
+func testGetPutDelete(t *testing.T, store server.PackageStore) {
+	a := server.NewPackage("a", nil)
+	b := server.NewPackageWithDependents("b", []string{"a"}, []string{"c", "d"})
+	put(t, store, a, b)
+
+	store.View(func(tx server.ReadTx) error {
+		if tx.Size() != 2 {
+			t.Errorf("expected size 2, got %d", tx.Size())
+		}
+		got, ok := tx.Get("b")
+		if !ok {
+			t.Fatal("expected to find b")
+		}
+		if got.Name() != "b" || !reflect.DeepEqual(describe(got), describe(b)) {
+			t.Errorf("expected %v, got %v", describe(b), describe(got))
+		}
+		if _, ok := tx.Get("missing"); ok {
+			t.Error("expected missing package not to be found")
+		}
+		return nil
+	})
+
+	// putting a package again replaces it
+	b2 := server.NewPackage("b", []string{})
+	put(t, store, b2)
+
+	store.Update(func(tx server.WriteTx) error {
+		if got, _ := tx.Get("b"); !reflect.DeepEqual(describe(got), describe(b2)) {
+			t.Errorf("expected %v, got %v", describe(b2), describe(got))
+		}
+		if tx.Size() != 2 {
+			t.Errorf("expected size 2 after replacing b, got %d", tx.Size())
+		}
+		tx.Delete("a")
+		tx.Delete("missing")
+		return nil
+	})
+
+	store.View(func(tx server.ReadTx) error {
+		if _, ok := tx.Get("a"); ok {
+			t.Error("expected a to be deleted")
+		}
+		if tx.Size() != 1 {
+			t.Errorf("expected size 1, got %d", tx.Size())
+		}
+		return nil
+	})
+}
+
+func testReadYourWrites(t *testing.T, store server.PackageStore) {
+	put(t, store, server.NewPackage("a", nil))
+
+	store.Update(func(tx server.WriteTx) error {
+		tx.Put(server.NewPackage("b", []string{"a"}))
+		if _, ok := tx.Get("b"); !ok {
+			t.Error("expected to see b inside the transaction that put it")
+		}
+		tx.Delete("a")
+		if _, ok := tx.Get("a"); ok {
+			t.Error("expected not to see a inside the transaction that deleted it")
+		}
+		if tx.Size() != 1 {
+			t.Errorf("expected size 1 inside the transaction, got %d", tx.Size())
+		}
+		return nil
+	})
+}
+
+func testRollback(t *testing.T, store server.PackageStore) {
+	put(t, store, server.NewPackage("a", nil), server.NewPackage("b", nil))
+	before := contents(t, store)
+
+	abort := errors.New("abort")
+	err := store.Update(func(tx server.WriteTx) error {
+		tx.Put(server.NewPackage("c", []string{"a"}))
+		tx.Put(server.NewPackageWithDependents("a", nil, []string{"c"}))
+		tx.Delete("b")
+		tx.Put(server.NewPackage("b", []string{"x"}))
+		return abort
+	})
+	if err != abort {
+		t.Errorf("expected Update to return the error, got %v", err)
+	}
+
+	if after := contents(t, store); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected %v after rolling back, got %v", before, after)
+	}
+}
+
+func testRollbackOnPanic(t *testing.T, store server.PackageStore) {
+	put(t, store, server.NewPackage("a", nil))
+	before := contents(t, store)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to reach the caller")
+			}
+		}()
+		store.Update(func(tx server.WriteTx) error {
+			tx.Put(server.NewPackage("b", nil))
+			tx.Delete("a")
+			panic("abort")
+		})
+	}()
+
+	if after := contents(t, store); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected %v after rolling back, got %v", before, after)
+	}
+	// the store must still be usable
+	put(t, store, server.NewPackage("c", nil))
+}
+
+func testForEach(t *testing.T, store server.PackageStore) {
+	expected := make(map[string]bool)
+	pkgs := make([]*server.Package, 0)
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("pkg-%d", i)
+		expected[name] = true
+		pkgs = append(pkgs, server.NewPackage(name, nil))
+	}
+	put(t, store, pkgs...)
+
+	store.View(func(tx server.ReadTx) error {
+		seen := make(map[string]bool)
+		tx.ForEach(func(pkg *server.Package) bool {
+			if seen[pkg.Name()] {
+				t.Errorf("%s visited twice", pkg.Name())
+			}
+			seen[pkg.Name()] = true
+			return true
+		})
+		if !reflect.DeepEqual(seen, expected) {
+			t.Errorf("expected to visit %d packages, visited %d", len(expected), len(seen))
+		}
+
+		count := 0
+		tx.ForEach(func(pkg *server.Package) bool {
+			count++
+			return count < 10
+		})
+		if count != 10 {
+			t.Errorf("expected ForEach to stop after 10 packages, got %d", count)
+		}
+		return nil
+	})
+}
+
+func testKeyedTransactions(t *testing.T, store server.PackageStore) {
+	ks, ok := store.(server.KeyedStore)
+	if !ok {
+		t.Skip("not a KeyedStore")
+	}
+	put(t, store, server.NewPackage("a", nil))
+
+	err := ks.UpdateKeys([]string{"a", "b"}, func(tx server.WriteTx) error {
+		if _, ok := tx.Get("a"); !ok {
+			t.Error("expected to find a")
+		}
+		tx.Put(server.NewPackage("b", []string{"a"}))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.ViewKeys([]string{"b"}, func(tx server.ReadTx) error {
+		if _, ok := tx.Get("b"); !ok {
+			t.Error("expected to find b")
+		}
+		if tx.Size() != 2 {
+			t.Errorf("expected size 2, got %d", tx.Size())
+		}
+		return nil
+	})
+
+	abort := errors.New("abort")
+	ks.UpdateKeys([]string{"a", "c"}, func(tx server.WriteTx) error {
+		tx.Put(server.NewPackage("c", nil))
+		tx.Delete("a")
+		return abort
+	})
+	store.View(func(tx server.ReadTx) error {
+		_, a := tx.Get("a")
+		_, c := tx.Get("c")
+		if !a || c || tx.Size() != 2 {
+			t.Error("expected a keyed update to roll back")
+		}
+		return nil
+	})
+}
+
+func testReverseEdges(t *testing.T, store server.PackageStore) {
+	w := server.NewWorker(store)
+
+	if w.Add(server.NewPackage("c", []string{"a", "b"})) {
+		t.Error("expected adding c to fail, its dependencies are missing")
+	}
+	w.Add(server.NewPackage("a", nil))
+	w.Add(server.NewPackage("b", []string{"a"}))
+	if !w.Add(server.NewPackage("c", []string{"a", "b"})) {
+		t.Fatal("expected c to be added")
+	}
+
+	expected := map[string][2][]string{
+		"a": {{}, {"b", "c"}},
+		"b": {{"a"}, {"c"}},
+		"c": {{"a", "b"}, {}},
+	}
+	if got := contents(t, store); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if w.Remove("a") || w.Remove("b") {
+		t.Error("expected removing a package with dependents to fail")
+	}
+	if !w.Remove("c") {
+		t.Fatal("expected c to be removed")
+	}
+	expected = map[string][2][]string{
+		"a": {{}, {"b"}},
+		"b": {{"a"}, {}},
+	}
+	if got := contents(t, store); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	if !w.Remove("b") || !w.Remove("a") || !w.Remove("a") {
+		t.Error("expected b and a to be removed")
+	}
+	if got := contents(t, store); len(got) != 0 {
+		t.Errorf("expected an empty store, got %v", got)
+	}
+}
+
+func testConcurrent(t *testing.T, store server.PackageStore) {
+	w := server.NewWorker(store)
+	r := rand.New(rand.NewSource(1))
+	pkgs := make([]*server.Package, 200)
+	for i := range pkgs {
+		deps := make([]string, 0)
+		for j := r.Intn(4); i > 0 && j > 0; j-- {
+			deps = append(deps, pkgs[r.Intn(i)].Name())
+		}
+		pkgs[i] = server.NewPackage(fmt.Sprintf("pkg-%d", i), deps)
+	}
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 1000; i++ {
+				pkg := pkgs[r.Intn(len(pkgs))]
+				switch r.Intn(4) {
+				case 0, 1:
+					w.Add(server.NewPackage(pkg.Name(), pkg.Dependencies()))
+				case 2:
+					w.Remove(pkg.Name())
+				case 3:
+					w.Query(pkg.Name())
+					store.View(func(tx server.ReadTx) error {
+						tx.ForEach(func(*server.Package) bool { return true })
+						return nil
+					})
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	store.View(func(tx server.ReadTx) error {
+		if problems := server.Check(tx); len(problems) != 0 {
+			t.Errorf("expected a consistent store, got %v", problems)
+		}
+		return nil
+	})
+	contents(t, store)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate and key read from files, and reads them
+// again whenever either file changes, so that a renewed certificate is used
+// from the next connection on without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	l    sync.Mutex
+	cert *tls.Certificate
+	// modification times of the files the certificate was read from
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// NewCertReloader returns a reloader for the PEM encoded certificate and key
+// in certFile and keyFile, and fails if they can't be read right away
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config. If the files
+// changed but can't be read, e.g. because they are only half written, the
+// previous certificate is kept until they can.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if err := r.reload(); err != nil {
+		log.Printf("could not reload certificate %s: %s", r.certFile, err.Error())
+	}
+	return r.cert, nil
+}
+
+// reload reads the certificate again if either file changed since it was last
+// read
+func (r *CertReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		log.Printf("reloaded certificate %s", r.certFile)
+	}
+	r.cert = &cert
+	r.certTime = certInfo.ModTime()
+	r.keyTime = keyInfo.ModTime()
+	return nil
+}
+
+// NewTLSConfig returns a server configuration serving the certificate in
+// certFile and keyFile, reloaded whenever they change. With clientCAFile set,
+// clients must present a certificate signed by one of the CAs in it.
+func NewTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// NewClientTLSConfig returns a client configuration trusting the CAs in caFile,
+// and presenting the certificate in certFile and keyFile if they are set,
+// reloaded whenever they change
+func NewClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if certFile == "" {
+		return config, nil
+	}
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return reloader.GetCertificate(nil)
+	}
+	return config, nil
+}
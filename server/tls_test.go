@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pem    []byte
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), serial: 1}
+}
+
+// issue returns a new PEM encoded certificate and key for 127.0.0.1
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("test %d", ca.serial)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data to name, dated modTime so that a rewrite within the
+// file system's timestamp resolution still counts as a change
+func writeFile(t *testing.T, name string, data []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tempDir returns a directory removed once the test ends
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// dialTLS sends request over a new TLS connection and returns the response
+// and the serial number of the server's certificate
+func dialTLS(addr string, config *tls.Config, request string) (string, int64, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return "", 0, err
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimSpace(response), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+// Testing that only clients with a certificate signed by the client CA are
+// served
+func TestTLS(t *testing.T) {
+	dir := tempDir(t)
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	writeFile(t, filepath.Join(dir, "server.pem"), certPEM, time.Now())
+	writeFile(t, filepath.Join(dir, "server-key.pem"), keyPEM, time.Now())
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem, time.Now())
+	config, err := NewTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithTLS(config))
+	addr, _ := startIndexer(t, p)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientPEM, clientKeyPEM := ca.issue(t, x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, _, err := dialTLS(addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}, "INDEX|a|"); err != nil || response != ResponseOK {
+		t.Errorf("expected %s with a client certificate, got %s %v", ResponseOK, response, err)
+	}
+	if response, _, err := dialTLS(addr, &tls.Config{RootCAs: roots}, "QUERY|a|"); err == nil {
+		t.Errorf("expected no answer without a client certificate, got %s", response)
+	}
+
+	plain := dialIndexer(t, addr)
+	plain.send(t, "QUERY|a|")
+	if response, err := plain.receive(); err == nil {
+		t.Errorf("expected no answer over plain TCP, got %s", response)
+	}
+}
+
+// Testing that a new certificate is served once both files are replaced
+func TestCertReload(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	ca := newTestCA(t)
+	modTime := time.Now()
+	certPEM, keyPEM := ca.issue(t, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, certPEM, modTime)
+	writeFile(t, keyFile, keyPEM, modTime)
+	config, err := NewTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPackageIndexer(10, 4, NewMapStore(), 0, WithTLS(config))
+	addr, _ := startIndexer(t, p)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := &tls.Config{RootCAs: roots}
+	expectSerial := func(expected int64) {
+		t.Helper()
+		if _, serial, err := dialTLS(addr, client, "QUERY|a|"); err != nil || serial != expected {
+			t.Errorf("expected certificate %d, got %d %v", expected, serial, err)
+		}
+	}
+	expectSerial(2)
+
+	// a certificate without its key isn't used yet
+	certPEM, keyPEM = ca.issue(t, x509.ExtKeyUsageServerAuth)
+	modTime = modTime.Add(time.Second)
+	writeFile(t, certFile, certPEM, modTime)
+	expectSerial(2)
+
+	writeFile(t, keyFile, keyPEM, modTime)
+	expectSerial(3)
+}
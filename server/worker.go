@@ -2,23 +2,76 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 )
 
+// never sent, requests that don't follow the protocol get ERROR, but other
+// front ends tell them apart from requests the server can't take
+const responseInvalid = "INVALID"
+
 type Worker struct {
 	id         string
 	store      PackageStore
 	workerChan chan *Worker
+	limits     Limits
+	backupDir  string
+	// records every successful mutation if set
+	journal *Journal
+	// refuses every command that would change the store
+	readOnly bool
+	// commits INDEX and REMOVE to the cluster and asks it for QUERY, if set
+	cluster *ClusterNode
+	// forwards INDEX and REMOVE upstream and reads QUERY through, if set
+	mirror *Mirror
+	// tracks connections for Shutdown, if set
+	conns *connTracker
+	// bounds how long clients can take and how much they can send
+	connLimits ConnectionLimits
+	// checks AUTH tokens and what clients are allowed to do, if set
+	credentials *Credentials
+	// role of clients that haven't authenticated
+	anonymous Role
+	// throttles clients making too many requests, if set
+	rateLimiter *RateLimiter
+	// keeps the digest of the store between DIGEST requests, if set
+	digests *digestCache
 }
 
 func (w *Worker) handleRequest(conn net.Conn) {
+	defer w.conns.remove(conn)
+	reader := bufio.NewReader(conn)
+	// responses go through client, so that slow readers are cut off
+	client := w.connLimits.writer(conn)
+	s := w.newConnSession(conn)
 	for {
-		request, err := bufio.NewReader(conn).ReadString('\n')
+		// the server is shutting down, the connection is closed between requests
+		if !w.conns.idle(conn) {
+			conn.Close()
+			return
+		}
+		request, err := w.connLimits.readRequest(conn, reader)
 		//METRICS: start request handle timer
 		//METRICS: defer calculate total time for request
 
+		// an idle client isn't waiting for anything, and is cut off silently
+		if err == errIdle {
+			log.Printf("closing connection from %s: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			return
+		}
+		// a client too slow or sending too much is told so before being cut off
+		if err == ErrRequestTooLong || isTimeout(err) {
+			log.Printf("closing connection from %s: %s", conn.RemoteAddr(), err.Error())
+			respond(client, ResponseError)
+			conn.Close()
+			return
+		}
 		// If we have an error, then we need to close the connection
 		if err != nil {
 			log.Printf("error reading from client %s", err.Error())
@@ -30,156 +83,571 @@ func (w *Worker) handleRequest(conn net.Conn) {
 			}
 			return
 		}
+		if !w.conns.active(conn) {
+			return
+		}
 
-		Request, success := parseRequestString(request)
-		if !success {
-			_, err := conn.Write([]byte(ResponseError + "\n"))
-			if err != nil {
-				log.Printf("error writing to connection %s", err.Error())
-			}
+		Request, err := parseRequestString(request, w.limits)
+		if errors.Is(err, ErrQuotaExceeded) {
+			log.Printf("rejected request: %s", err.Error())
+			respond(client, ResponseQuota)
+			continue
+		}
+		if err != nil {
+			respond(client, ResponseError)
 			continue
 		}
 
-		// Handle valid commands
-		if Request.command == CmdIndex {
-			//METRICS: increment command index count
-			if !w.Add(&Package{
-				name:         Request.pkg,
-				dependencies: Request.dependencies,
-				dependents:   make(map[string]interface{}),
-			}) {
-				conn.Write([]byte(fmt.Sprintf("%s\n", ResponseFail)))
-				continue
-			}
-			_, err := conn.Write([]byte(fmt.Sprintf("%s\n", ResponseOK)))
+		respond(client, w.handle(s, Request))
+	}
+}
 
-			if err != nil {
-				log.Printf("error writing to connection %s", err.Error())
-			}
-			log.Printf("added %v", Request.pkg)
-			continue
+// session is what a worker knows of a client across its requests
+type session struct {
+	// where the client connects from, rate limits count clients by address
+	// until they authenticate
+	remoteAddr string
+	// counts the client apart from others with the same address until it
+	// authenticates, if set
+	connection string
+	// who the client is, anonymous until it authenticates
+	identity Identity
+}
+
+// newSession returns the session of a client connecting from remoteAddr
+func (w *Worker) newSession(remoteAddr string) *session {
+	return &session{remoteAddr: remoteAddr, identity: Identity{Role: w.anonymous}}
+}
+
+// unixConnections numbers the connections to Unix domain sockets
+var unixConnections uint64
+
+// newConnSession returns the session of the client on conn. Clients of Unix
+// domain sockets all have the same address, so each of their connections is
+// counted on its own.
+func (w *Worker) newConnSession(conn net.Conn) *session {
+	s := w.newSession(conn.RemoteAddr().String())
+	if conn.LocalAddr().Network() == "unix" {
+		s.connection = fmt.Sprintf("unix connection %d", atomic.AddUint64(&unixConnections, 1))
+	}
+	return s
+}
+
+// authenticate makes the client of session s whoever token belongs to, and
+// returns false if it belongs to no one. Unlike AUTH it isn't counted against
+// the client's rate limits, for front ends that send a token with every
+// request. The worker must have credentials.
+func (w *Worker) authenticate(s *session, token string) bool {
+	id, ok := w.credentials.Authenticate(token)
+	if !ok {
+		log.Printf("refused a bad token from %s", s.remoteAddr)
+		return false
+	}
+	s.identity = id
+	return true
+}
+
+// handle runs a request for the client of session s and returns the response
+func (w *Worker) handle(s *session, r *Request) string {
+	if !w.throttle(s, !isReadOnly(r)) {
+		//METRICS: increment throttled requests count
+		return ResponseThrottled
+	}
+
+	if r.command == CmdAuth {
+		if w.credentials == nil {
+			return ResponseError
 		}
+		if !w.authenticate(s, r.pkg) {
+			return ResponseDenied
+		}
+		return ResponseOK
+	}
+	if !w.permits(s, requiredRole(r)) {
+		log.Printf("refused %s to %q, a %s", r.command, s.identity.Name, s.identity.Role)
+		return ResponseDenied
+	}
 
-		if Request.command == CmdQuery {
-			if w.Query(Request.pkg) {
-				_, err := conn.Write([]byte(fmt.Sprintf("%s\n", ResponseOK)))
-				if err != nil {
-					log.Printf("error writing to connection %s", err.Error())
-				}
-				continue
-			}
-			_, err := conn.Write([]byte(fmt.Sprintf("%s\n", ResponseFail)))
-			if err != nil {
-				log.Printf("error writing to connection %s", err.Error())
-			}
-			continue
+	if w.readOnly && !isReadOnly(r) {
+		log.Printf("refused %s on a read only server", r.command)
+		return ResponseError
+	}
+	if w.cluster != nil && !isReadOnly(r) && r.command != CmdIndex && r.command != CmdRemove {
+		log.Printf("refused %s on a cluster node", r.command)
+		return ResponseError
+	}
+
+	// Handle valid commands
+	if r.command == CmdIndex {
+		//METRICS: increment command index count
+		err := w.index(&Package{
+			name:         r.pkg,
+			dependencies: r.dependencies,
+			dependents:   make(map[string]interface{}),
+		})
+		if errors.Is(err, ErrQuotaExceeded) {
+			log.Printf("rejected %s: %s", r.pkg, err.Error())
+			return ResponseQuota
 		}
+		if errors.Is(err, ErrNotLeader) || errors.Is(err, ErrUpstream) {
+			log.Printf("could not index %s: %s", r.pkg, err.Error())
+			return ResponseError
+		}
+		if err != nil {
+			return ResponseFail
+		}
+		log.Printf("added %v", r.pkg)
+		return ResponseOK
+	}
 
-		if Request.command == CmdRemove {
-			_, ok := w.Get(Request.pkg)
-			if !ok {
-				_, err := conn.Write([]byte(fmt.Sprintf("%s\n", ResponseOK)))
-				if err != nil {
-				}
-				continue
-			}
+	if r.command == CmdQuery {
+		pkg, found, err := w.get(r.pkg)
+		if err != nil {
+			log.Printf("could not query %s: %s", r.pkg, err.Error())
+			return ResponseError
+		}
+		if found {
+			r.found = pkg
+			return ResponseOK
+		}
+		return ResponseFail
+	}
 
-			if w.Remove(Request.pkg) {
-				_, err := conn.Write([]byte(fmt.Sprintf("%s\n", ResponseOK)))
-				if err != nil {
-					log.Printf("error writing to connection %s", err.Error())
-				}
-				continue
-			}
-			_, err := conn.Write([]byte(fmt.Sprintf("%s\n", ResponseFail)))
-			if err != nil {
-				log.Printf("error writing to connection %s", err.Error())
-			}
-			continue
+	if r.command == CmdFetch {
+		// asked like QUERY first, so that cluster nodes check that they still
+		// lead and mirrors read through
+		found, err := w.query(r.pkg)
+		if err != nil {
+			log.Printf("could not fetch %s: %s", r.pkg, err.Error())
+			return ResponseError
+		}
+		if !found {
+			return ResponseFail
+		}
+		pkgs, ok := w.Fetch(r.pkg)
+		if !ok {
+			return ResponseFail
+		}
+		return formatFetch(pkgs)
+	}
+
+	if r.command == CmdRemove {
+		removed, err := w.remove(r.pkg)
+		if err != nil {
+			log.Printf("could not remove %s: %s", r.pkg, err.Error())
+			return ResponseError
+		}
+		if removed {
+			return ResponseOK
+		}
+		return ResponseFail
+	}
+
+	if r.command == CmdFsck {
+		if r.pkg != FsckCheck && r.pkg != FsckRepair {
+			return ResponseError
+		}
+		if w.Fsck(r.pkg == FsckRepair) {
+			return ResponseOK
+		}
+		return ResponseFail
+	}
+
+	if r.command == CmdDigest {
+		if !strings.HasPrefix(r.pkg, DigestRoot) {
+			return ResponseError
+		}
+		node, err := w.Digest(strings.TrimPrefix(r.pkg, DigestRoot))
+		if err != nil {
+			log.Printf("%s %s failed: %s", r.command, r.pkg, err.Error())
+			return ResponseError
 		}
+		return formatDigest(node)
 	}
+
+	if r.command == CmdBackup || r.command == CmdRestore {
+		path, err := w.backupPath(r.pkg)
+		if err != nil {
+			log.Printf("rejected %s: %s", r.command, err.Error())
+			return ResponseError
+		}
+		if r.command == CmdBackup {
+			err = SaveSnapshotFile(path, w.store)
+		} else {
+			err = w.Restore(path)
+		}
+		if err != nil {
+			log.Printf("%s %s failed: %s", r.command, path, err.Error())
+			return ResponseFail
+		}
+		log.Printf("%s %s done", r.command, path)
+		return ResponseOK
+	}
+	return ResponseError
 }
 
-func (w *Worker) Add(pkg *Package) bool {
-	w.store.Lock()
-	defer w.store.Unlock()
-	if len(pkg.dependencies) > 0 && !w.find(pkg.dependencies...) {
-		return false
+// run handles a request made by another front end than the line protocol like
+// the worker would on it, and returns the response. Requests that the line
+// protocol couldn't express get responseInvalid.
+func (w *Worker) run(s *session, command, name string, dependencies []string) string {
+	if dependencies == nil {
+		dependencies = make([]string, 0)
 	}
+	r, err := newRequest(command, name, dependencies, w.limits)
+	if errors.Is(err, ErrQuotaExceeded) {
+		return ResponseQuota
+	}
+	if err != nil {
+		return responseInvalid
+	}
+	return w.handle(s, r)
+}
 
-	if _, ok := w.store.Get(pkg.name); ok {
+// lookup runs QUERY for name like run, and returns the package found along
+// with the response. The package and its edges are read in the same
+// transaction that answered the QUERY.
+func (w *Worker) lookup(s *session, name string) (*Package, string) {
+	r, err := newRequest(CmdQuery, name, make([]string, 0), w.limits)
+	if err != nil {
+		return nil, responseInvalid
+	}
+	response := w.handle(s, r)
+	return r.found, response
+}
+
+// throttle takes a token from the client's bucket for a request, and returns
+// false if there is none left
+func (w *Worker) throttle(s *session, write bool) bool {
+	return w.rateLimiter == nil || w.rateLimiter.Allow(rateLimitClient(s), write)
+}
+
+// permits returns true if the client is allowed to do what role can
+func (w *Worker) permits(s *session, role Role) bool {
+	return w.credentials == nil || s.identity.Role >= role
+}
+
+// isReadOnly returns true if the request doesn't change the store
+func isReadOnly(r *Request) bool {
+	switch r.command {
+	case CmdQuery, CmdBackup, CmdDigest, CmdFetch:
 		return true
+	case CmdFsck:
+		return r.pkg == FsckCheck
 	}
-	w.store.Put(pkg)
-	w.addDependents(pkg.dependencies, pkg.name)
-	return true
+	return false
+}
+
+// respond writes a single response line to the client
+func respond(conn net.Conn, response string) {
+	_, err := conn.Write([]byte(fmt.Sprintf("%s\n", response)))
+	if err != nil {
+		log.Printf("error writing to connection %s", err.Error())
+	}
+}
+
+// index, query, get and remove go through the cluster if the worker is part of one,
+// or the mirror if it has one, and straight to the store otherwise
+
+func (w *Worker) index(pkg *Package) error {
+	if w.cluster != nil {
+		return w.cluster.Index(pkg)
+	}
+	if w.mirror != nil {
+		return w.mirror.Index(pkg)
+	}
+	return w.Index(pkg)
+}
+
+func (w *Worker) query(name string) (bool, error) {
+	if w.cluster != nil {
+		return w.cluster.Query(name)
+	}
+	if w.mirror != nil {
+		return w.mirror.Query(name)
+	}
+	return w.Query(name), nil
+}
+
+func (w *Worker) get(name string) (*Package, bool, error) {
+	if w.cluster != nil {
+		return w.cluster.Get(name)
+	}
+	if w.mirror != nil {
+		return w.mirror.Get(name)
+	}
+	pkg, ok := w.Get(name)
+	return pkg, ok, nil
+}
+
+func (w *Worker) remove(name string) (bool, error) {
+	if w.cluster != nil {
+		return w.cluster.Remove(name)
+	}
+	if w.mirror != nil {
+		return w.mirror.Remove(name)
+	}
+	return w.Remove(name), nil
+}
+
+func (w *Worker) Add(pkg *Package) bool {
+	return w.Index(pkg) == nil
+}
+
+// Index adds pkg to the store unless it is already there. It returns
+// ErrMissingDependency if any of its dependencies aren't indexed yet, and
+// ErrQuotaExceeded if it would go over the worker's limits.
+func (w *Worker) Index(pkg *Package) error {
+	if err := w.limits.checkPackage(pkg.name, pkg.dependencies); err != nil {
+		return err
+	}
+
+	// only the package and its dependencies are touched
+	keys := append([]string{pkg.name}, pkg.dependencies...)
+	err := updateKeys(w.store, keys, func(tx WriteTx) error {
+		if len(pkg.dependencies) > 0 && !find(tx, pkg.dependencies...) {
+			return ErrMissingDependency
+		}
+
+		if _, ok := tx.Get(pkg.name); ok {
+			return nil
+		}
+		if err := w.limits.checkSize(tx); err != nil {
+			return err
+		}
+		tx.Put(pkg)
+		if err := addDependents(tx, pkg.dependencies, pkg.name); err != nil {
+			return err
+		}
+		w.record(Mutation{Command: CmdIndex, Package: pkg.name, Dependencies: pkg.dependencies})
+		return nil
+	})
+	if err != nil && err != ErrMissingDependency && !errors.Is(err, ErrQuotaExceeded) {
+		log.Printf("error adding package %s: %s", pkg.name, err.Error())
+	}
+	return err
+}
+
+// Fetch returns the package called name followed by every package it depends
+// on, directly or not, or false if it isn't indexed
+func (w *Worker) Fetch(name string) ([]*Package, bool) {
+	var pkgs []*Package
+	err := w.store.View(func(tx ReadTx) error {
+		seen := map[string]bool{name: true}
+		queue := []string{name}
+		for len(queue) > 0 {
+			pkg, ok := tx.Get(queue[0])
+			queue = queue[1:]
+			if !ok {
+				continue
+			}
+			pkgs = append(pkgs, pkg)
+			for _, dep := range pkg.dependencies {
+				if !seen[dep] {
+					seen[dep] = true
+					queue = append(queue, dep)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("error fetching package %s: %s", name, err.Error())
+		return nil, false
+	}
+	return pkgs, len(pkgs) > 0
 }
 
 func (w *Worker) Get(name string) (*Package, bool) {
-	w.store.RLock()
-	defer w.store.RUnlock()
+	var pkg *Package
 	var ok bool
-	pkg, ok := w.store.Get(name)
+	err := viewKeys(w.store, []string{name}, func(tx ReadTx) error {
+		pkg, ok = tx.Get(name)
+		return nil
+	})
+	if err != nil {
+		log.Printf("error getting package %s: %s", name, err.Error())
+		return nil, false
+	}
 	return pkg, ok
 }
 
 func (w *Worker) Remove(name string) bool {
-	w.store.Lock()
-	defer w.store.Unlock()
+	for {
+		// look at the package first to learn which other packages the removal
+		// touches, then check again once they are all part of the transaction
+		pkg, ok := w.Get(name)
+		if !ok {
+			return true
+		}
+		keys := packageKeys(pkg)
 
-	pkg, ok := w.store.Get(name)
-	if !ok {
-		return true
-	}
-	if len(pkg.dependents) > 0 && w.find(mapKeys(pkg.dependents)...) {
-		return false
+		removed, retry := true, false
+		err := updateKeys(w.store, keys, func(tx WriteTx) error {
+			pkg, ok := tx.Get(name)
+			if !ok {
+				return nil
+			}
+			if !covers(keys, packageKeys(pkg)) {
+				// the package was re-indexed in the meantime
+				retry = true
+				return nil
+			}
+			if len(pkg.dependents) > 0 && find(tx, mapKeys(pkg.dependents)...) {
+				removed = false
+				return nil
+			}
+			tx.Delete(name)
+			if err := removeDependents(tx, pkg.dependencies, name); err != nil {
+				return err
+			}
+			w.record(Mutation{Command: CmdRemove, Package: name})
+			return nil
+		})
+		if err != nil {
+			log.Printf("error removing package %s: %s", name, err.Error())
+			return false
+		}
+		if !retry {
+			return removed
+		}
 	}
-	w.store.Delete(name)
-	w.removeDependents(pkg.dependencies, name)
-
-	return true
 }
 
 func (w *Worker) Query(name string) bool {
-	w.store.RLock()
-	defer w.store.RUnlock()
-	return w.find(name)
+	var found bool
+	err := viewKeys(w.store, []string{name}, func(tx ReadTx) error {
+		found = find(tx, name)
+		return nil
+	})
+	if err != nil {
+		log.Printf("error querying package %s: %s", name, err.Error())
+		return false
+	}
+	return found
 }
 
-// for every package in 'packages', 'dependent' will not be a dependent
-func (w *Worker) addDependents(packages []string, dependent string) {
+// for every package in 'packages', 'dependent' will now be a dependent.
+// A missing package means the store is inconsistent, see Check.
+func addDependents(tx WriteTx, packages []string, dependent string) error {
 	for _, pkg := range packages {
-		currentPackage, ok := w.store.Get(pkg)
+		currentPackage, ok := tx.Get(pkg)
 		if !ok {
-			log.Fatalf("missing package %s", pkg)
+			return fmt.Errorf("missing package %s", pkg)
 		}
+		currentPackage = currentPackage.copy()
 		currentPackage.dependents[dependent] = struct{}{}
-		w.store.Put(currentPackage)
+		tx.Put(currentPackage)
 	}
+	return nil
 }
 
-// for every package in 'packages', 'dependent' will no longer be a dependent
-func (w *Worker) removeDependents(packages []string, dependent string) {
+// for every package in 'packages', 'dependent' will no longer be a dependent.
+// A missing package means the store is inconsistent, see Check.
+func removeDependents(tx WriteTx, packages []string, dependent string) error {
 	for _, dep := range packages {
-		pkg, ok := w.store.Get(dep)
+		pkg, ok := tx.Get(dep)
 		if !ok {
-			log.Fatalf("missing package %s", pkg)
+			return fmt.Errorf("missing package %s", dep)
 		}
+		pkg = pkg.copy()
 		delete(pkg.dependents, dependent)
-		w.store.Put(pkg)
+		tx.Put(pkg)
+	}
+	return nil
+}
+
+// Fsck checks the store for inconsistencies, logging every problem found, and
+// returns true if there are none. With repair set, reverse edges are rebuilt
+// first and only the problems left afterwards count.
+func (w *Worker) Fsck(repair bool) bool {
+	var problems []Problem
+	var err error
+	if repair {
+		err = w.store.Update(func(tx WriteTx) error {
+			problems = Repair(tx)
+			w.record(Mutation{Command: CmdReset})
+			return nil
+		})
+	} else {
+		err = w.store.View(func(tx ReadTx) error {
+			problems = Check(tx)
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("error checking store: %s", err.Error())
+		return false
+	}
+
+	for _, p := range problems {
+		log.Printf("fsck: %s", p)
+	}
+	return len(problems) == 0
+}
+
+// Restore replaces the store with the backup at path, see RestoreSnapshotFile
+func (w *Worker) Restore(path string) error {
+	restored, err := readRestore(path)
+	if err != nil {
+		return err
+	}
+	return w.store.Update(func(tx WriteTx) error {
+		replaceAll(tx, restored)
+		w.record(Mutation{Command: CmdReset})
+		return nil
+	})
+}
+
+// record adds m to the journal, if the worker has one. It must be the last
+// thing done in the transaction making the change.
+func (w *Worker) record(m Mutation) {
+	if w.journal != nil {
+		w.journal.append(m)
 	}
 }
 
+// backupPath returns the path of the backup called name in the backup directory.
+// Names can't point outside of it.
+func (w *Worker) backupPath(name string) (string, error) {
+	if w.backupDir == "" {
+		return "", errors.New("no backup directory configured")
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid backup name %q", name)
+	}
+	return filepath.Join(w.backupDir, name), nil
+}
+
 // search function to find a package in the package store
-func (w *Worker) find(pkgs ...string) bool {
+func find(tx ReadTx, pkgs ...string) bool {
 	if len(pkgs) == 0 {
 		return false
 	}
-	if w.store.Size() == 0 {
+	if tx.Size() == 0 {
 		return false
 	}
 	for _, pkg := range pkgs {
-		if _, ok := w.store.Get(pkg); !ok {
+		if _, ok := tx.Get(pkg); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// packageKeys returns the name of the package together with the names of its
+// dependencies and dependents
+func packageKeys(pkg *Package) []string {
+	keys := make([]string, 0, 1+len(pkg.dependencies)+len(pkg.dependents))
+	keys = append(keys, pkg.name)
+	keys = append(keys, pkg.dependencies...)
+	return append(keys, mapKeys(pkg.dependents)...)
+}
+
+// covers returns true if every key in 'b' is also in 'a'
+func covers(a, b []string) bool {
+	m := sliceToMap(a)
+	for _, k := range b {
+		if _, ok := m[k]; !ok {
 			return false
 		}
 	}
@@ -0,0 +1,85 @@
+// store-diff compares the packages of two running indexers through the digests
+// they answer DIGEST with, and prints every package that isn't the same in
+// both: missing from the target, extra in it, or with different dependencies.
+// Only the branches of the digests that differ are fetched, so comparing two
+// large indexes that are nearly the same is cheap. With -repair, the target is
+// then made the same as the source.
+//
+// It exits with status 1 if differences are left, and 2 if either indexer
+// can't be reached.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/john-cai/package-indexer/server"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "Make the target the same as the source")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-repair] source-host:port target-host:port\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	source := dial(flag.Arg(0))
+	defer source.Close()
+	target := dial(flag.Arg(1))
+	defer target.Close()
+
+	differences := compare(source, target)
+	if *repair && len(differences) > 0 {
+		requests, err := server.ReconcileRequests(source, target, differences)
+		if err != nil {
+			log.Printf("could not plan the repair: %s", err.Error())
+			os.Exit(2)
+		}
+		for _, request := range requests {
+			response, err := target.Send(request)
+			if err != nil {
+				log.Printf("could not send %s: %s", request, err.Error())
+				os.Exit(2)
+			}
+			if response != server.ResponseOK {
+				log.Printf("%s: %s", request, response)
+			}
+		}
+		log.Printf("sent %d requests to %s", len(requests), flag.Arg(1))
+		differences = compare(source, target)
+	}
+
+	if len(differences) > 0 {
+		os.Exit(1)
+	}
+}
+
+func dial(addr string) *server.Client {
+	c, err := server.Dial(addr)
+	if err != nil {
+		log.Printf("could not connect to %s: %s", addr, err.Error())
+		os.Exit(2)
+	}
+	return c
+}
+
+// compare prints and returns the differences between source and target
+func compare(source, target *server.Client) []server.Difference {
+	differences, err := server.Compare(source, target)
+	if err != nil {
+		log.Printf("could not compare: %s", err.Error())
+		os.Exit(2)
+	}
+	for _, d := range differences {
+		fmt.Println(d)
+	}
+	log.Printf("%d differences", len(differences))
+	return differences
+}
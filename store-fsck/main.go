@@ -0,0 +1,65 @@
+// store-fsck checks a package store snapshot for inconsistencies: dependencies
+// that don't exist, and dependencies and dependents that don't mirror each
+// other. With -repair, reverse edges are rebuilt from the dependencies and the
+// snapshot is written back.
+//
+// It exits with status 1 if problems are left, and 2 if the snapshot can't be read.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/john-cai/package-indexer/server"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "Rebuild reverse edges and write the snapshot back")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-repair] snapshot\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	store := server.NewMapStore()
+	if err := server.LoadSnapshotFile(path, store); err != nil {
+		log.Printf("could not read snapshot %s: %s", path, err.Error())
+		os.Exit(2)
+	}
+
+	var problems []server.Problem
+	store.View(func(tx server.ReadTx) error {
+		problems = server.Check(tx)
+		log.Printf("checked %d packages, %d problems", tx.Size(), len(problems))
+		return nil
+	})
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if *repair && len(problems) > 0 {
+		store.Update(func(tx server.WriteTx) error {
+			problems = server.Repair(tx)
+			return nil
+		})
+		if err := server.SaveSnapshotFile(path, store); err != nil {
+			log.Printf("could not write snapshot %s: %s", path, err.Error())
+			os.Exit(2)
+		}
+		log.Printf("repaired %s, %d problems left", path, len(problems))
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,130 @@
+// store-migrate moves the packages in a snapshot from one PackageStore backend
+// to another. The source snapshot is loaded into the -from-store backend, and
+// the packages are copied into the -to-store backend in dependency order, then
+// the destination is compared with the source package by package and written
+// out as a new snapshot.
+//
+// Progress is appended to a log next to the destination every -checkpoint
+// packages. If the migration is interrupted, running it again with -resume
+// replays the log and carries on from there. The log is removed once the
+// destination snapshot is written.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/john-cai/package-indexer/server"
+)
+
+func main() {
+	from := flag.String("from", "", "Snapshot to read packages from")
+	fromStore := flag.String("from-store", server.StoreMap, "Store to load the source snapshot into")
+	to := flag.String("to", "", "Snapshot to write the migrated packages to")
+	toStore := flag.String("to-store", server.StoreMap, "Store to migrate the packages into")
+	checkpoint := flag.Int("checkpoint", 10000, "Save progress every this many packages")
+	resume := flag.Bool("resume", false, "Resume an interrupted migration from its progress log")
+	flag.Parse()
+
+	if *from == "" || *to == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := server.NewStore(*fromStore)
+	if err != nil {
+		log.Fatalf("invalid -from-store: %s", err.Error())
+	}
+	dst, err := server.NewStore(*toStore)
+	if err != nil {
+		log.Fatalf("invalid -to-store: %s", err.Error())
+	}
+
+	if err := server.LoadSnapshotFile(*from, src); err != nil {
+		log.Fatalf("could not read %s: %s", *from, err.Error())
+	}
+
+	if _, err := os.Stat(*to); err == nil {
+		log.Fatalf("%s already exists", *to)
+	}
+	progressPath := *to + ".progress"
+	progress, err := openProgress(progressPath, *resume, dst)
+	if err != nil {
+		log.Fatalf("could not open %s: %s", progressPath, err.Error())
+	}
+
+	// packages added since the last checkpoint
+	var pending []*server.Package
+	added, err := server.Migrate(src, dst, func(pkg *server.Package, done, total int) error {
+		if pkg != nil {
+			pending = append(pending, pkg)
+		}
+		if *checkpoint > 0 && done%*checkpoint == 0 && done < total {
+			log.Printf("migrated %d of %d packages", done, total)
+			if err := server.WriteMigrationLog(progress, pending); err != nil {
+				return err
+			}
+			pending = pending[:0]
+			return progress.Sync()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("migration failed: %s", err.Error())
+	}
+	if err := server.SaveSnapshotFile(*to, dst); err != nil {
+		log.Fatalf("could not write %s: %s", *to, err.Error())
+	}
+	progress.Close()
+	if err := os.Remove(progressPath); err != nil {
+		log.Printf("could not remove %s: %s", progressPath, err.Error())
+	}
+	log.Printf("migrated %d packages from %s (%s) to %s (%s)", added, *from, *fromStore, *to, *toStore)
+
+	differences, err := server.VerifyMigration(src, dst)
+	if err != nil {
+		log.Fatalf("could not verify migration: %s", err.Error())
+	}
+	for _, d := range differences {
+		fmt.Println(d)
+	}
+	if len(differences) > 0 {
+		log.Printf("verification failed, %d differences", len(differences))
+		os.Exit(1)
+	}
+	log.Printf("verified, source and destination match")
+}
+
+// openProgress opens the progress log at path for appending. When resuming, the
+// packages already in it are added to dst first, and an entry cut short by the
+// interruption is cut off.
+func openProgress(path string, resume bool, dst server.PackageStore) (*os.File, error) {
+	if !resume {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("a migration was interrupted, use -resume to carry on with it")
+		}
+		return f, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := server.ReadMigrationLog(f, dst)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	log.Printf("resuming the migration saved in %s", path)
+	return f, nil
+}
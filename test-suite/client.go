@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"strings"
@@ -22,6 +25,9 @@ const (
 	//ERROR code
 	ERROR = "ERROR"
 
+	//QUOTA code, the request went over one of the server's limits
+	QUOTA = "QUOTA"
+
 	//UNKNOWN code
 	UNKNOWN = "UNKNOWN"
 )
@@ -79,14 +85,25 @@ func (client *TCPPackageIndexerClient) Send(msg string) (ResponseCode, error) {
 		return ERROR, nil
 	}
 
+	if returnedString == QUOTA {
+		return QUOTA, nil
+	}
+
 	return UNKNOWN, fmt.Errorf("Error parsing message from server [%s]: %v", responseMsg, err)
 }
 
-// MakeTCPPackageIndexClient returns a new instance of the client
-func MakeTCPPackageIndexClient(name string, ip string, port int) (PackageIndexerClient, error) {
+// MakeTCPPackageIndexClient returns a new instance of the client, connected
+// over TLS if tlsConfig isn't nil
+func MakeTCPPackageIndexClient(name string, ip string, port int, tlsConfig *tls.Config) (PackageIndexerClient, error) {
 	host := fmt.Sprintf("%s:%d", ip, port)
 	log.Printf("%s connecting to [%s]", name, host)
-	conn, err := net.Dial("tcp", host)
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.Dial("tcp", host, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open connection to [%s]: %#v", host, err)
@@ -98,6 +115,28 @@ func MakeTCPPackageIndexClient(name string, ip string, port int) (PackageIndexer
 	}, nil
 }
 
+// LoadTLSConfig returns a client configuration trusting the CAs in caFile, and
+// presenting the certificate in certFile and keyFile if they are set
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates in [%s]", caFile)
+	}
+	config := &tls.Config{RootCAs: pool}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 func extendTimoutFor(conn net.Conn) {
 	whenWillThisConnectionTimeout := time.Now().Add(time.Second * 10)
 	conn.SetDeadline(whenWillThisConnectionTimeout)
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"math/big"
 	"net"
 	"testing"
+	"time"
 )
 
 func respondWith(t *testing.T, server net.Listener, responseCode string) {
@@ -18,7 +25,7 @@ func respondWith(t *testing.T, server net.Listener, responseCode string) {
 
 func TestMakeTCPPackageIndexClient(t *testing.T) {
 	portWithNobodyListeningTo := 8089
-	client, err := MakeTCPPackageIndexClient("portisntopen", "127.0.0.1", portWithNobodyListeningTo)
+	client, err := MakeTCPPackageIndexClient("portisntopen", "127.0.0.1", portWithNobodyListeningTo, nil)
 
 	if err == nil {
 		t.Errorf("Expected connection to [%d] to raise error as there's no server, got %v", portWithNobodyListeningTo, client)
@@ -36,7 +43,7 @@ func TestSend(t *testing.T) {
 
 	go respondWith(t, goodServer, "OK")
 
-	client, err := MakeTCPPackageIndexClient("goodPort", "127.0.0.1",goodPort)
+	client, err := MakeTCPPackageIndexClient("goodPort", "127.0.0.1",goodPort, nil)
 	if err != nil {
 		t.Fatalf("Error connecting to server: %v", err)
 	}
@@ -61,7 +68,7 @@ func TestSend(t *testing.T) {
 
 	go respondWith(t, badServer, "banana")
 
-	client, err = MakeTCPPackageIndexClient("badPort", "127.0.0.1", badPort)
+	client, err = MakeTCPPackageIndexClient("badPort", "127.0.0.1", badPort, nil)
 	if err != nil {
 		t.Fatalf("Error connecting to server: %v", err)
 	}
@@ -72,3 +79,64 @@ func TestSend(t *testing.T) {
 		t.Errorf("No error returned for bad responseCode from server: %#v", responseCode)
 	}
 }
+
+// selfSignedCertificate returns a certificate for 127.0.0.1, signed by itself
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error generating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSendTLS(t *testing.T) {
+	cert := selfSignedCertificate(t)
+	tlsServer, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Error opening test server: %v", err)
+	}
+	defer tlsServer.Close()
+	go func() {
+		for {
+			conn, err := tlsServer.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, "OK")
+		}
+	}()
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	port := tlsServer.Addr().(*net.TCPAddr).Port
+
+	client, err := MakeTCPPackageIndexClient("tls", "127.0.0.1", port, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("Error connecting to server: %v", err)
+	}
+	defer client.Close()
+	responseCode, err := client.Send("A")
+	if err != nil || responseCode != OK {
+		t.Errorf("Expected responseCode to be OK, got %v %v", responseCode, err)
+	}
+
+	_, err = MakeTCPPackageIndexClient("untrusted", "127.0.0.1", port, &tls.Config{RootCAs: x509.NewCertPool()})
+	if err == nil {
+		t.Errorf("Expected connection to a server with an untrusted certificate to raise error")
+	}
+}
@@ -17,10 +17,20 @@ func main() {
 	randomSeed := flag.Int64("seed", 42, "A positive value used to seed the random number generator")
 	debugMode := flag.Bool("debug", false, "Prints some extra information and opens a HTTP server on port 8081")
 	unluckiness := flag.Int("unluckiness", 5, "A % showing the probability of something bad happenning, like broken messages being sent or random disconnects")
+	tlsCA := flag.String("tls-ca", "", "The CA certificate the server's certificate is signed by, connects over TLS if set")
+	tlsCert := flag.String("tls-cert", "", "The client certificate to present to the server, if it asks for one")
+	tlsKey := flag.String("tls-key", "", "The private key of the client certificate")
 	flag.Parse()
 	rand.Seed(*randomSeed)
 
 	test := MakeTestRun(*ip, *port, *concurrencyLevel, *unluckiness)
+	if *tlsCA != "" {
+		config, err := LoadTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading TLS configuration: %v", err)
+		}
+		test.TLSConfig = config
+	}
 
 	if *debugMode {
 		log.Println("Running in DEBUG mode")
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"crypto/tls"
 	"log"
 	"math/rand"
 	"os"
@@ -16,7 +17,9 @@ type TestRun struct {
 	StartedAt        time.Time
 	ConcurrencyLevel int
 	Unluckiness      int
-	waiting          sync.WaitGroup
+	// connects over TLS if set
+	TLSConfig *tls.Config
+	waiting   sync.WaitGroup
 }
 
 // Start starts the test
@@ -27,6 +30,7 @@ func (t *TestRun) Start() {
 	log.Printf("expected server port [%d]", t.ServerPort)
 	log.Printf("concurrency level    [%d]", t.ConcurrencyLevel)
 	log.Printf("unluckiness          [%d]", t.Unluckiness)
+	log.Printf("tls                  [%t]", t.TLSConfig != nil)
 	t.StartedAt = time.Now()
 	log.Println("TESTRUN Starting...")
 }
@@ -192,7 +196,7 @@ func verifyAllPackages(client PackageIndexerClient, packages []*Package, expecte
 }
 
 func makeClient(clientName string, t *TestRun) PackageIndexerClient {
-	client, err := MakeTCPPackageIndexClient(clientName, t.ServerIP, t.ServerPort)
+	client, err := MakeTCPPackageIndexClient(clientName, t.ServerIP, t.ServerPort, t.TLSConfig)
 	if err != nil {
 		t.Failf("Error opening client to t.ServerPort [%d]: %v", t.ServerPort, err)
 	}